@@ -0,0 +1,255 @@
+package gluahttp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const errorKindAuth = "auth"
+
+// redacted replaces credentials in error messages and logs.
+const redacted = "[REDACTED]"
+
+// authenticator adds credentials to outgoing requests.
+type authenticator interface {
+	// authenticate sets the credentials on req. It is called again on the
+	// copy of the request that is sent after a challenge.
+	authenticate(req *http.Request) error
+	// challenge is given the 401 response to a request and reports whether
+	// the request should be sent once more.
+	challenge(res *http.Response) (bool, error)
+	// secrets lists the credentials that must be redacted from error
+	// messages.
+	secrets() secrets
+}
+
+func (h *httpModule) parseAuth(options *lua.LTable) (authenticator, error) {
+	reqAuth, ok := options.RawGetString("auth").(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+
+	switch authType := lua.LVAsString(reqAuth.RawGetString("type")); authType {
+	case "", "basic":
+		user, pass, err := authUserPass(reqAuth)
+		if err != nil {
+			return nil, err
+		}
+		return &basicAuth{user: user, pass: pass}, nil
+	case "digest":
+		user, pass, err := authUserPass(reqAuth)
+		if err != nil {
+			return nil, err
+		}
+		return &digestAuth{user: user, pass: pass, challenges: h.digestChallenges}, nil
+	case "bearer":
+		token := reqAuth.RawGetString("token")
+		if lua.LVIsFalse(token) {
+			return nil, fmt.Errorf("bearer auth requires a token")
+		}
+		return &headerAuth{scheme: "Bearer", credentials: token.String()}, nil
+	case "header":
+		credentials := reqAuth.RawGetString("credentials")
+		if lua.LVIsFalse(credentials) {
+			return nil, fmt.Errorf("header auth requires credentials")
+		}
+		return &headerAuth{scheme: lua.LVAsString(reqAuth.RawGetString("scheme")), credentials: credentials.String()}, nil
+	case "oauth2":
+		return h.parseOAuth2Auth(reqAuth)
+	case "aws_sigv4":
+		auth, err := parseSigV4Auth(reqAuth)
+		if err != nil {
+			return nil, err
+		}
+		return auth, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth type %q", authType)
+	}
+}
+
+func authUserPass(reqAuth *lua.LTable) (string, string, error) {
+	user := reqAuth.RawGetString("user")
+	pass := reqAuth.RawGetString("pass")
+	if lua.LVIsFalse(user) || lua.LVIsFalse(pass) {
+		return "", "", fmt.Errorf("auth table must contain no nil user and pass fields")
+	}
+	return user.String(), pass.String(), nil
+}
+
+// send performs req, answering at most one authentication challenge.
+func (h *httpModule) send(req *http.Request, state *requestState) (*http.Response, error) {
+	if err := state.prepare(req); err != nil {
+		return nil, err
+	}
+
+	res, err := h.exchange(req, state)
+	if err != nil || state.auth == nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	retry, err := state.auth.challenge(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if !retry {
+		return res, nil
+	}
+
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	retryReq, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.prepare(retryReq); err != nil {
+		return nil, err
+	}
+	return h.exchange(retryReq, state)
+}
+
+// rewindRequest returns a copy of req that can be sent again.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retryReq := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("request body can't be sent twice")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retryReq.Body = body
+	}
+	return retryReq, nil
+}
+
+type basicAuth struct {
+	user string
+	pass string
+}
+
+func (a *basicAuth) authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.user, a.pass)
+	return nil
+}
+
+func (a *basicAuth) challenge(res *http.Response) (bool, error) {
+	return false, nil
+}
+
+func (a *basicAuth) secrets() secrets {
+	return secrets{
+		verbatim: []string{base64.StdEncoding.EncodeToString([]byte(a.user + ":" + a.pass))},
+		params:   []string{a.pass},
+	}
+}
+
+// headerAuth sends fixed credentials in the Authorization header, such as
+// bearer tokens.
+type headerAuth struct {
+	scheme      string
+	credentials string
+}
+
+func (a *headerAuth) authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", a.header())
+	return nil
+}
+
+func (a *headerAuth) header() string {
+	if a.scheme == "" {
+		return a.credentials
+	}
+	return a.scheme + " " + a.credentials
+}
+
+func (a *headerAuth) challenge(res *http.Response) (bool, error) {
+	return false, nil
+}
+
+func (a *headerAuth) secrets() secrets {
+	return secrets{verbatim: []string{a.header()}, params: []string{a.credentials}}
+}
+
+// secrets are the credentials to hide from error messages. Short passwords
+// and tokens would match unrelated parts of a message, so they are only
+// hidden where they can appear as they are: in query parameters.
+type secrets struct {
+	// verbatim are hidden wherever they appear, such as whole
+	// Authorization headers.
+	verbatim []string
+	// params are hidden when they are the whole value of a query parameter.
+	params []string
+}
+
+func (s *secrets) add(other secrets) {
+	s.verbatim = append(s.verbatim, other.verbatim...)
+	s.params = append(s.params, other.params...)
+}
+
+// queryParamPattern matches the query parameters of the URLs quoted in error
+// messages.
+var queryParamPattern = regexp.MustCompile(`[?&][^?&#=\s"]+=[^&#\s"]*`)
+
+// redactQueryParams hides the values of the query parameters found in
+// message for which redact returns true.
+func redactQueryParams(message string, redact func(name string, value string) bool) string {
+	return queryParamPattern.ReplaceAllStringFunc(message, func(param string) string {
+		rawName, rawValue, _ := strings.Cut(param[1:], "=")
+		name, value := rawName, rawValue
+		if unescaped, err := url.QueryUnescape(rawName); err == nil {
+			name = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(rawValue); err == nil {
+			value = unescaped
+		}
+		if !redact(name, value) {
+			return param
+		}
+		return param[:len(param)-len(rawValue)] + redacted
+	})
+}
+
+// redactedError hides credentials from the message of err while keeping
+// it available to errors.As for classification.
+type redactedError struct {
+	err     error
+	secrets secrets
+}
+
+func redactSecrets(err error, secrets secrets) error {
+	if len(secrets.verbatim) == 0 && len(secrets.params) == 0 {
+		return err
+	}
+	return &redactedError{err: err, secrets: secrets}
+}
+
+func (e *redactedError) Error() string {
+	message := e.err.Error()
+	for _, secret := range e.secrets.verbatim {
+		if secret != "" {
+			message = strings.ReplaceAll(message, secret, redacted)
+		}
+	}
+	return redactQueryParams(message, func(name string, value string) bool {
+		for _, secret := range e.secrets.params {
+			if secret != "" && value == secret {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,392 @@
+package gluahttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheEntries is the size of the in-memory cache used when
+// EnableCache is given no storage.
+const defaultCacheEntries = 1000
+
+// cacheableStatusCodes are the status codes that may be cached, including
+// with heuristic freshness, as listed in RFC 9110 section 15.1.
+var cacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// EnableCache caches responses to GET requests in storage, following the
+// rules of RFC 9111 for shared caches since every script using the module
+// sees the same entries. A nil storage means an in-memory LRU cache. Scripts
+// can bypass the cache with the cache option.
+func (h *httpModule) EnableCache(storage CacheStorage) *httpModule {
+	if storage == nil {
+		storage = NewMemoryCache(defaultCacheEntries)
+	}
+	h.cache = storage
+	return h
+}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	StatusCode   int
+	Status       string
+	Proto        string
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// Vary holds the values of the request headers named by the Vary
+	// header of the response.
+	Vary map[string]string
+}
+
+// cacheKey identifies the response to req. Requests sent with their own
+// transport, such as through another proxy or Unix socket, may reach a
+// different server for the same URL, so its config is part of the key.
+func cacheKey(req *http.Request, state *requestState) string {
+	if state.transport == nil {
+		return req.URL.String()
+	}
+	return sha256Hex([]byte(fmt.Sprintf("%+v", *state.transport))) + " " + req.URL.String()
+}
+
+// cachedRoundTrip answers req from the cache when it holds a fresh response,
+// revalidates stale responses that have validators, and stores the
+// responses that may be cached once their body was read.
+func (h *httpModule) cachedRoundTrip(req *http.Request, state *requestState) (*http.Response, error) {
+	if h.cache == nil || state.noCache {
+		return h.roundTrip(req, state)
+	}
+
+	key := cacheKey(req, state)
+	switch req.Method {
+	case "GET":
+	case "HEAD", "OPTIONS", "TRACE":
+		return h.roundTrip(req, state)
+	default:
+		// Unsafe methods invalidate the stored response, see RFC 9111
+		// section 4.4.
+		res, err := h.roundTrip(req, state)
+		if err == nil && res.StatusCode < 400 {
+			h.cache.Delete(key)
+		}
+		return res, err
+	}
+
+	reqDirectives := requestCacheDirectives(req.Header)
+	if _, ok := reqDirectives["no-store"]; ok {
+		return h.roundTrip(req, state)
+	}
+	// Conditional and range requests made by the script are its own
+	// business.
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" || req.Header.Get("Range") != "" {
+		return h.roundTrip(req, state)
+	}
+
+	entry := h.loadCacheEntry(key)
+	if entry != nil && !entry.matches(req) {
+		entry = nil
+	}
+	if entry != nil && entry.fresh(reqDirectives, time.Now()) {
+		state.fromCache = true
+		return entry.response(req, time.Now()), nil
+	}
+
+	sent := req
+	if entry != nil {
+		etag := entry.Header.Get("ETag")
+		lastModified := entry.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			sent = req.Clone(req.Context())
+			if etag != "" {
+				sent.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				sent.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	requestTime := time.Now()
+	res, err := h.roundTrip(sent, state)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := time.Now()
+
+	if res.StatusCode == http.StatusNotModified && sent != req {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+
+		entry.update(res, requestTime, responseTime)
+		h.storeCacheEntry(key, entry)
+		state.fromCache = true
+		return entry.response(req, responseTime), nil
+	}
+
+	if !storable(req, res) {
+		return res, nil
+	}
+
+	entry = &cacheEntry{
+		StatusCode:   res.StatusCode,
+		Status:       res.Status,
+		Proto:        res.Proto,
+		Header:       res.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		Vary:         varyValues(req, res.Header),
+	}
+	res.Body = &cachingBody{ReadCloser: res.Body, complete: func(body []byte) {
+		entry.Body = body
+		h.storeCacheEntry(key, entry)
+	}}
+	return res, nil
+}
+
+func (h *httpModule) loadCacheEntry(key string) *cacheEntry {
+	data, ok := h.cache.Get(key)
+	if !ok {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		h.cache.Delete(key)
+		return nil
+	}
+	return entry
+}
+
+func (h *httpModule) storeCacheEntry(key string, entry *cacheEntry) {
+	if data, err := json.Marshal(entry); err == nil {
+		h.cache.Set(key, data)
+	}
+}
+
+// storable reports whether a shared cache may store res, see RFC 9111
+// section 3.
+func storable(req *http.Request, res *http.Response) bool {
+	if !cacheableStatusCodes[res.StatusCode] {
+		return false
+	}
+	// Responses to redirected requests belong to another URL.
+	if res.Request != nil && res.Request.URL.String() != req.URL.String() {
+		return false
+	}
+	if strings.TrimSpace(res.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	directives := parseCacheControl(res.Header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["private"]; ok {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return false
+		}
+	}
+
+	_, maxAge := directives["max-age"]
+	_, sMaxAge := directives["s-maxage"]
+	return maxAge || sMaxAge || res.Header.Get("Expires") != "" ||
+		res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != ""
+}
+
+func varyValues(req *http.Request, header http.Header) map[string]string {
+	values := map[string]string{}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				values[name] = strings.Join(req.Header.Values(name), ",")
+			}
+		}
+	}
+	return values
+}
+
+// matches reports whether req selects the entry, see RFC 9111 section 4.1.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(req.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) fresh(reqDirectives map[string]string, now time.Time) bool {
+	directives := parseCacheControl(e.Header.Values("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return false
+	}
+	if _, ok := reqDirectives["no-cache"]; ok {
+		return false
+	}
+
+	age := e.age(now)
+	if maxAge, ok := directiveSeconds(reqDirectives, "max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < e.freshnessLifetime(directives)
+}
+
+// freshnessLifetime follows RFC 9111 section 4.2.1.
+func (e *cacheEntry) freshnessLifetime(directives map[string]string) time.Duration {
+	if sMaxAge, ok := directiveSeconds(directives, "s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := directiveSeconds(directives, "max-age"); ok {
+		return maxAge
+	}
+
+	date := e.date()
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	// Heuristic freshness, a tenth of the time since the last change.
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		return date.Sub(lastModified) / 10
+	}
+	return 0
+}
+
+// age follows RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	ageValue, _ := strconv.Atoi(e.Header.Get("Age"))
+	correctedAgeValue := time.Duration(ageValue)*time.Second + e.ResponseTime.Sub(e.RequestTime)
+
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// update applies the headers of a 304 response, see RFC 9111 section 4.3.4.
+func (e *cacheEntry) update(res *http.Response, requestTime time.Time, responseTime time.Time) {
+	for name, values := range res.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+}
+
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+
+	major, minor, _ := http.ParseHTTPVersion(e.Proto)
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         e.Proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// requestCacheDirectives parses the Cache-Control header of a request,
+// falling back to Pragma for HTTP/1.0 clients.
+func requestCacheDirectives(header http.Header) map[string]string {
+	if values := header.Values("Cache-Control"); len(values) > 0 {
+		return parseCacheControl(values)
+	}
+	directives := map[string]string{}
+	if strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		directives["no-cache"] = ""
+	}
+	return directives
+}
+
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(argument), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cachingBody hands the body to complete once it was read to the end.
+type cachingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	complete func(body []byte)
+	done     bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.complete(b.buf.Bytes())
+	}
+	return n, err
+}
@@ -0,0 +1,93 @@
+package gluahttp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const errorKindDecompress = "decompress"
+
+// compressBody encodes a request body with the given Content-Encoding.
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", encoding)
+	}
+
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBody undoes the codings listed in a Content-Encoding header,
+// last applied first. ok is false when one of them isn't supported, in which
+// case the body is left as is.
+func decompressBody(contentEncoding string, body []byte) (decoded []byte, ok bool, err error) {
+	codings := strings.Split(contentEncoding, ",")
+	for _, coding := range codings {
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip", "deflate", "br":
+		default:
+			return body, false, nil
+		}
+	}
+
+	decoded = body
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoded, err = decompress(strings.ToLower(strings.TrimSpace(codings[i])), decoded)
+		if err != nil {
+			return nil, true, errorWithKind(errorKindDecompress, err)
+		}
+	}
+	return decoded, true, nil
+}
+
+func decompress(coding string, body []byte) ([]byte, error) {
+	var r io.Reader
+
+	switch coding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case "deflate":
+		// "deflate" is meant to be zlib wrapped, but some servers send raw
+		// deflate data instead.
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(body))
+			defer fr.Close()
+			r = fr
+		} else {
+			defer zr.Close()
+			r = zr
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	}
+
+	return ioutil.ReadAll(r)
+}
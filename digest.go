@@ -0,0 +1,284 @@
+package gluahttp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// digestChallenge is the state of RFC 7616 Digest authentication with a
+// host, kept between requests so that later ones can authenticate without
+// being challenged again.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	stale     bool
+	// nc counts the requests made with nonce.
+	nc uint32
+}
+
+// digestChallenges holds the last challenge received from each host.
+type digestChallenges struct {
+	mu     sync.Mutex
+	byHost map[string]*digestChallenge
+}
+
+func newDigestChallenges() *digestChallenges {
+	return &digestChallenges{byHost: map[string]*digestChallenge{}}
+}
+
+// next returns a copy of the challenge for host with the nonce count
+// incremented, or nil if the host never challenged us.
+func (c *digestChallenges) next(host string) *digestChallenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, ok := c.byHost[host]
+	if !ok {
+		return nil
+	}
+	challenge.nc++
+	next := *challenge
+	return &next
+}
+
+func (c *digestChallenges) set(host string, challenge *digestChallenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byHost[host] = challenge
+}
+
+type digestAuth struct {
+	user       string
+	pass       string
+	challenges *digestChallenges
+	// sentNonce is the nonce used by the last authenticate call.
+	sentNonce string
+}
+
+func digestHost(req *http.Request) string {
+	return req.URL.Scheme + "://" + req.URL.Host
+}
+
+func (a *digestAuth) authenticate(req *http.Request) error {
+	challenge := a.challenges.next(digestHost(req))
+	if challenge == nil {
+		return nil
+	}
+
+	authorization, err := challenge.authorization(a.user, a.pass, req.Method, req.URL.RequestURI())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	a.sentNonce = challenge.nonce
+	return nil
+}
+
+func (a *digestAuth) challenge(res *http.Response) (bool, error) {
+	challenge, err := parseDigestChallenge(res.Header)
+	if err != nil || challenge == nil {
+		return false, err
+	}
+
+	a.challenges.set(digestHost(res.Request), challenge)
+
+	// Being challenged again for the nonce we just used means the
+	// credentials were wrong, unless the server says it merely expired.
+	return challenge.nonce != a.sentNonce || challenge.stale, nil
+}
+
+func (a *digestAuth) secrets() secrets {
+	return secrets{params: []string{a.pass}}
+}
+
+func (c *digestChallenge) authorization(user, pass, method, uri string) (string, error) {
+	newHash, err := digestHashFunc(c.algorithm)
+	if err != nil {
+		return "", err
+	}
+	h := func(s string) string {
+		digest := newHash()
+		digest.Write([]byte(s))
+		return hex.EncodeToString(digest.Sum(nil))
+	}
+
+	cnonce, err := digestCnonce()
+	if err != nil {
+		return "", err
+	}
+	nc := fmt.Sprintf("%08x", c.nc)
+
+	ha1 := h(user + ":" + c.realm + ":" + pass)
+	if strings.HasSuffix(strings.ToLower(c.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if c.qop == "" {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+	}
+
+	params := []string{
+		"username=" + quoteAuthParam(user),
+		"realm=" + quoteAuthParam(c.realm),
+		"nonce=" + quoteAuthParam(c.nonce),
+		"uri=" + quoteAuthParam(uri),
+		"response=" + quoteAuthParam(response),
+	}
+	if c.algorithm != "" {
+		params = append(params, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		params = append(params, "opaque="+quoteAuthParam(c.opaque))
+	}
+	if c.qop != "" {
+		params = append(params, "qop="+c.qop, "nc="+nc, "cnonce="+quoteAuthParam(cnonce))
+	}
+	return "Digest " + strings.Join(params, ", "), nil
+}
+
+func quoteAuthParam(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+func digestHashFunc(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5", "MD5-SESS":
+		return md5.New, nil
+	case "SHA-256", "SHA-256-SESS":
+		return sha256.New, nil
+	}
+	return nil, errorWithKind(errorKindAuth, fmt.Errorf("unsupported digest algorithm %q", algorithm))
+}
+
+func digestCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseDigestChallenge picks the strongest Digest challenge offered in the
+// WWW-Authenticate headers, or returns nil if there is none.
+func parseDigestChallenge(header http.Header) (*digestChallenge, error) {
+	var best *digestChallenge
+	var unsupported error
+
+	for _, value := range header.Values("WWW-Authenticate") {
+		for _, params := range parseAuthChallenges(value, "digest") {
+			challenge := &digestChallenge{
+				realm:     params["realm"],
+				nonce:     params["nonce"],
+				opaque:    params["opaque"],
+				algorithm: params["algorithm"],
+				stale:     strings.EqualFold(params["stale"], "true"),
+			}
+
+			if _, err := digestHashFunc(challenge.algorithm); err != nil {
+				unsupported = err
+				continue
+			}
+
+			if qop, ok := params["qop"]; ok {
+				for _, option := range strings.Split(qop, ",") {
+					if strings.TrimSpace(option) == "auth" {
+						challenge.qop = "auth"
+					}
+				}
+				if challenge.qop == "" {
+					unsupported = errorWithKind(errorKindAuth, fmt.Errorf("unsupported digest qop %q", qop))
+					continue
+				}
+			}
+
+			if best == nil || strings.HasPrefix(strings.ToUpper(challenge.algorithm), "SHA-256") {
+				best = challenge
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, unsupported
+	}
+	return best, nil
+}
+
+// parseAuthChallenges returns the parameters of every challenge for scheme
+// in a WWW-Authenticate header value, which may list several challenges.
+func parseAuthChallenges(value string, scheme string) []map[string]string {
+	var challenges []map[string]string
+	var current map[string]string
+
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, " \t,")
+		if value == "" {
+			break
+		}
+
+		end := strings.IndexAny(value, " \t,=")
+		if end < 0 {
+			end = len(value)
+		}
+		token := value[:end]
+		value = strings.TrimLeft(value[end:], " \t")
+
+		if !strings.HasPrefix(value, "=") {
+			// A token without a value starts a new challenge.
+			current = nil
+			if strings.EqualFold(token, scheme) {
+				current = map[string]string{}
+				challenges = append(challenges, current)
+			}
+			continue
+		}
+
+		var param string
+		param, value = parseAuthParamValue(strings.TrimLeft(value[1:], " \t"))
+		if current != nil {
+			current[strings.ToLower(token)] = param
+		}
+	}
+
+	return challenges
+}
+
+func parseAuthParamValue(value string) (string, string) {
+	if !strings.HasPrefix(value, `"`) {
+		end := strings.IndexAny(value, " \t,")
+		if end < 0 {
+			end = len(value)
+		}
+		return value[:end], value[end:]
+	}
+
+	var param strings.Builder
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+1 < len(value) {
+				i++
+				param.WriteByte(value[i])
+			}
+		case '"':
+			return param.String(), value[i+1:]
+		default:
+			param.WriteByte(value[i])
+		}
+	}
+	return param.String(), ""
+}
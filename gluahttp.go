@@ -1,32 +1,76 @@
 package gluahttp
 
 import (
-	"context"
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"time"
 )
 
 type httpModule struct {
-	do func(req *http.Request) (*http.Response, error)
+	do    func(req *http.Request) (*http.Response, error)
+	trace bool
+
+	// client is nil when the module was created with NewHttpModuleWithDo,
+	// in which case redirects are left entirely to do.
+	client *http.Client
+
+	digestChallenges *digestChallenges
+	oauth2Providers  map[string]*OAuth2Provider
+	transports       *transports
+	allowInsecureTls bool
+	proxy            proxyOptions
+	pool             *poolStats
+	cache            CacheStorage
+	middlewares      []Middleware
+	logger           *requestLogger
+
+	// transport is the untracked transport built by
+	// NewHttpModuleWithOptions, that per-request transports start from.
+	transport *http.Transport
 }
 
 type empty struct{}
 
 func NewHttpModule(client *http.Client) *httpModule {
-	return NewHttpModuleWithDo(client.Do)
+	c := *client
+	c.CheckRedirect = checkRedirect(client.CheckRedirect)
+
+	h := NewHttpModuleWithDo(c.Do)
+	h.client = &c
+	return h
 }
 
 func NewHttpModuleWithDo(do func(req *http.Request) (*http.Response, error)) *httpModule {
 	return &httpModule{
-		do: do,
+		do:               do,
+		digestChallenges: newDigestChallenges(),
+		oauth2Providers:  map[string]*OAuth2Provider{},
+		transports:       newTransports(),
+		pool:             newPoolStats(),
 	}
 }
 
+// SetTrace enables timing collection for every request, as if each one was
+// made with the trace option.
+func (h *httpModule) SetTrace(enabled bool) *httpModule {
+	h.trace = enabled
+	return h
+}
+
+// AllowInsecureTls lets scripts disable certificate verification with the
+// insecure_skip_verify tls option.
+func (h *httpModule) AllowInsecureTls(allowed bool) *httpModule {
+	h.allowInsecureTls = allowed
+	return h
+}
+
 func (h *httpModule) Loader(L *lua.LState) int {
 	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"get":           h.get,
@@ -37,8 +81,14 @@ func (h *httpModule) Loader(L *lua.LState) int {
 		"put":           h.put,
 		"request":       h.request,
 		"request_batch": h.requestBatch,
+		"oauth2":        h.oauth2,
+		"pool_stats":    h.poolStats,
+		"on_request":    httpOnRequest,
+		"on_response":   httpOnResponse,
 	})
 	registerHttpResponseType(mod, L)
+	registerHttpErrorType(mod, L)
+	registerOAuth2ProviderType(mod, L)
 	L.Push(mod)
 	return 1
 }
@@ -76,19 +126,31 @@ func (h *httpModule) requestBatch(L *lua.LState) int {
 	amountRequests := requests.Len()
 
 	errs := make([]error, amountRequests)
-	responses := make([]*lua.LUserData, amountRequests)
+	methods := make([]string, amountRequests)
+	urls := make([]string, amountRequests)
+	options := make([]*lua.LTable, amountRequests)
+	valid := make([]bool, amountRequests)
+	responses := make([]*luaHttpResponse, amountRequests)
 	sem := make(chan empty, amountRequests)
 
 	i := 0
 
+	// Every hook runs before the first request starts: L isn't safe for
+	// concurrent use, hooks may change tables shared between requests, and
+	// a hook raising an error must not leave requests running.
 	requests.ForEach(func(_ lua.LValue, value lua.LValue) {
-		requestTable := toTable(value)
-
-		if requestTable != nil {
-			method := requestTable.RawGet(lua.LNumber(1)).String()
-			url := requestTable.RawGet(lua.LNumber(2)).String()
-			options := toTable(requestTable.RawGet(lua.LNumber(3)))
+		if requestTable := toTable(value); requestTable != nil {
+			methods[i], urls[i], options[i] = runRequestHooks(L,
+				requestTable.RawGet(lua.LNumber(1)).String(),
+				requestTable.RawGet(lua.LNumber(2)).String(),
+				toTable(requestTable.RawGet(lua.LNumber(3))))
+			valid[i] = true
+		}
+		i = i + 1
+	})
 
+	for i = 0; i < amountRequests; i++ {
+		if valid[i] {
 			go func(i int, L *lua.LState, method string, url string, options *lua.LTable) {
 				response, err := h.doRequest(L, method, url, options)
 
@@ -101,15 +163,13 @@ func (h *httpModule) requestBatch(L *lua.LState) int {
 				}
 
 				sem <- empty{}
-			}(i, L, method, url, options)
+			}(i, L, methods[i], urls[i], options[i])
 		} else {
-			errs[i] = errors.New("Request must be a table")
+			errs[i] = errorWithKind(errorKindInvalidRequest, errors.New("Request must be a table"))
 			responses[i] = nil
 			sem <- empty{}
 		}
-
-		i = i + 1
-	})
+	}
 
 	for i = 0; i < amountRequests; i++ {
 		<-sem
@@ -120,12 +180,16 @@ func (h *httpModule) requestBatch(L *lua.LState) int {
 	responsesTable := L.NewTable()
 	for i = 0; i < amountRequests; i++ {
 		if errs[i] == nil {
-			responsesTable.Append(responses[i])
+			response := newHttpResponse(responses[i], L)
+			responsesTable.Append(response)
 			errorsTable.Append(lua.LNil)
+			runResponseHooks(L, response, lua.LNil)
 		} else {
+			httpError := newHttpError(errs[i], methods[i], urls[i], L)
 			responsesTable.Append(lua.LNil)
-			errorsTable.Append(lua.LString(fmt.Sprintf("%s", errs[i])))
+			errorsTable.Append(httpError)
 			hasErrors = true
+			runResponseHooks(L, lua.LNil, httpError)
 		}
 	}
 
@@ -139,10 +203,33 @@ func (h *httpModule) requestBatch(L *lua.LState) int {
 	}
 }
 
-func (h *httpModule) doRequest(L *lua.LState, method string, url string, options *lua.LTable) (*lua.LUserData, error) {
-	req, err := http.NewRequest(strings.ToUpper(method), url, nil)
+// doRequest only reads L, it may run on another goroutine than the script.
+func (h *httpModule) doRequest(L *lua.LState, method string, url string, options *lua.LTable) (response *luaHttpResponse, err error) {
+	state := newRequestState(L)
+	start := time.Now()
+	var req *http.Request
+	var res *http.Response
+	var body []byte
+	if h.logger != nil {
+		rawUrl := url
+		defer func() {
+			h.logger.log(state, method, rawUrl, start, req, res, len(body), err)
+		}()
+	}
+	defer func() {
+		if err != nil {
+			err = state.redact(err)
+		}
+	}()
+
+	url, unixSocket, err := splitUnixSocketUrl(url)
 	if err != nil {
-		return nil, err
+		return nil, errorWithKind(errorKindInvalidUrl, err)
+	}
+
+	req, err = http.NewRequest(strings.ToUpper(method), url, nil)
+	if err != nil {
+		return nil, errorWithKind(errorKindInvalidUrl, err)
 	}
 
 	if ctx := L.Context(); ctx != nil {
@@ -161,6 +248,25 @@ func (h *httpModule) doRequest(L *lua.LState, method string, url string, options
 			req.URL.RawQuery = reqQuery.String()
 		}
 
+		if options.RawGetString("cache") == lua.LFalse {
+			state.noCache = true
+		}
+
+		if etag, ok := options.RawGetString("if_none_match").(lua.LString); ok {
+			req.Header.Set("If-None-Match", string(etag))
+		}
+		switch since := options.RawGetString("if_modified_since").(type) {
+		case lua.LNumber:
+			req.Header.Set("If-Modified-Since", time.Unix(int64(since), 0).UTC().Format(http.TimeFormat))
+		case lua.LString:
+			req.Header.Set("If-Modified-Since", string(since))
+		}
+
+		// The connection is closed once the response was read.
+		if options.RawGetString("keep_alive") == lua.LFalse {
+			req.Close = true
+		}
+
 		body := options.RawGet(lua.LString("body"))
 		if _, ok := body.(lua.LString); !ok {
 			// "form" is deprecated.
@@ -174,72 +280,145 @@ func (h *httpModule) doRequest(L *lua.LState, method string, url string, options
 
 		switch reqBody := body.(type) {
 		case lua.LString:
-			body := reqBody.String()
-			req.ContentLength = int64(len(body))
-			req.Body = ioutil.NopCloser(strings.NewReader(body))
-		}
-
-		reqTimeout := options.RawGet(lua.LString("timeout"))
-		if reqTimeout != lua.LNil {
-			duration := time.Duration(0)
-			switch reqTimeout.(type) {
-			case lua.LNumber:
-				duration = time.Second * time.Duration(int(reqTimeout.(lua.LNumber)))
-			case lua.LString:
-				duration, err = time.ParseDuration(string(reqTimeout.(lua.LString)))
+			body := []byte(reqBody.String())
+			if compress, ok := options.RawGetString("compress").(lua.LString); ok {
+				body, err = compressBody(string(compress), body)
 				if err != nil {
-					return nil, err
+					return nil, errorWithKind(errorKindInvalidOption, err)
 				}
+				req.Header.Set("Content-Encoding", string(compress))
 			}
-			ctx, cancel := context.WithTimeout(req.Context(), duration)
-			req = req.WithContext(ctx)
-			defer cancel()
-		}
-
-		// Basic auth
-		if reqAuth, ok := options.RawGet(lua.LString("auth")).(*lua.LTable); ok {
-			user := reqAuth.RawGetString("user")
-			pass := reqAuth.RawGetString("pass")
-			if !lua.LVIsFalse(user) && !lua.LVIsFalse(pass) {
-				req.SetBasicAuth(user.String(), pass.String())
-			} else {
-				return nil, fmt.Errorf("auth table must contain no nil user and pass fields")
+			req.ContentLength = int64(len(body))
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
 			}
 		}
 
+		state.timeouts, err = parseRequestTimeouts(options)
+		if err != nil {
+			return nil, errorWithKind(errorKindInvalidOption, err)
+		}
+
+		state.auth, err = h.parseAuth(options)
+		if err != nil {
+			return nil, errorWithKind(errorKindInvalidOption, err)
+		}
+
+		state.signer, err = parseHmacSigner(options)
+		if err != nil {
+			return nil, errorWithKind(errorKindInvalidOption, err)
+		}
+
+		if err := parseRedirectPolicy(options, &state.redirect); err != nil {
+			return nil, errorWithKind(errorKindInvalidOption, err)
+		}
+		if h.client == nil && state.redirect != defaultRedirectPolicy {
+			return nil, errorWithKind(errorKindInvalidOption, fmt.Errorf("redirect options require a module created with NewHttpModule"))
+		}
+
 		// Set these last. That way the code above doesn't overwrite them.
 		if reqHeaders, ok := options.RawGet(lua.LString("headers")).(*lua.LTable); ok {
 			reqHeaders.ForEach(func(key lua.LValue, value lua.LValue) {
 				req.Header.Set(key.String(), value.String())
 			})
 		}
+
+		// The transport asks for gzip and decodes it itself unless the
+		// request names its encodings.
+		if options.RawGetString("decompress") == lua.LFalse && req.Header.Get("Accept-Encoding") == "" {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		// An Authorization header set by the script wins over the auth option.
+		if authorization := req.Header.Get("Authorization"); authorization != "" {
+			state.auth = nil
+			state.secrets.verbatim = append(state.secrets.verbatim, authorization)
+		}
 	}
 
-	res, err := h.do(req)
+	state.transport, err = h.parseTransportConfig(options, unixSocket)
 	if err != nil {
-		return nil, err
+		return nil, errorWithKind(errorKindInvalidOption, err)
+	}
+	// Without TLS the transport would quietly fall back to HTTP/1.1.
+	if state.transport != nil && state.transport.httpVersion == "2" && req.URL.Scheme != "https" {
+		return nil, errorWithKind(errorKindInvalidOption, fmt.Errorf("http_version \"2\" requires an https URL, use \"h2c\" for HTTP/2 without TLS"))
+	}
+
+	if h.trace || (options != nil && lua.LVAsBool(options.RawGetString("trace"))) {
+		state.timings = newRequestTimings()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), state.timings.clientTrace()))
+	}
+	lifecycle := newRequestLifecycle(req.Context(), state.timeouts)
+	req = req.WithContext(httptrace.WithClientTrace(lifecycle.ctx, h.pool.clientTrace(state)))
+	defer h.pool.release(state)
+	req = withRequestState(req, state)
+
+	res, err = h.send(req, state)
+	if err != nil {
+		lifecycle.finish()
+		return nil, lifecycle.err(err)
 	}
 
+	res.Body = lifecycle.body(res.Body)
 	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return newHttpResponse(res, &body, len(body), L), nil
+	if state.timings != nil {
+		state.timings.finish()
+	}
+
+	if res.Uncompressed {
+		state.contentEncoding = "gzip"
+	}
+	if contentEncoding := res.Header.Get("Content-Encoding"); contentEncoding != "" && len(body) > 0 &&
+		(options == nil || options.RawGetString("decompress") != lua.LFalse) {
+		decoded, ok, err := decompressBody(contentEncoding, body)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			body = decoded
+			state.contentEncoding = contentEncoding
+			res.Header.Del("Content-Encoding")
+			res.Header.Del("Content-Length")
+			res.ContentLength = -1
+			res.Uncompressed = true
+		}
+	}
+
+	if options != nil && lua.LVAsBool(options.RawGetString("error_on_status")) && res.StatusCode >= 400 {
+		return nil, newStatusError(res, body)
+	}
+
+	return &luaHttpResponse{
+		res:      res,
+		body:     lua.LString(body),
+		bodySize: len(body),
+		state:    state,
+	}, nil
 }
 
 func (h *httpModule) doRequestAndPush(L *lua.LState, method string, url string, options *lua.LTable) int {
+	method, url, options = runRequestHooks(L, method, url, options)
 	response, err := h.doRequest(L, method, url, options)
 
 	if err != nil {
+		httpError := newHttpError(err, method, url, L)
+		runResponseHooks(L, lua.LNil, httpError)
 		L.Push(lua.LNil)
-		L.Push(lua.LString(fmt.Sprintf("%s", err)))
+		L.Push(httpError)
 		return 2
 	}
 
-	L.Push(response)
+	ud := newHttpResponse(response, L)
+	runResponseHooks(L, ud, lua.LNil)
+	L.Push(ud)
 	return 1
 }
 
@@ -0,0 +1,10 @@
+module github.com/cjoudrey/gluahttp
+
+go 1.24
+
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/net v0.35.0
+	golang.org/x/text v0.22.0
+)
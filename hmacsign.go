@@ -0,0 +1,189 @@
+package gluahttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hmacSigner adds an HMAC of selected parts of a request to one of its
+// headers, as configured by the sign option.
+type hmacSigner struct {
+	newHash         func() hash.Hash
+	secret          string
+	parts           []string
+	header          string
+	encoding        string
+	prefix          string
+	separator       string
+	timestampHeader string
+	timestampFormat string
+}
+
+func parseHmacSigner(options *lua.LTable) (*hmacSigner, error) {
+	sign, ok := options.RawGetString("sign").(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+
+	signer := &hmacSigner{
+		secret:          lua.LVAsString(sign.RawGetString("secret")),
+		header:          lua.LVAsString(sign.RawGetString("header")),
+		encoding:        lua.LVAsString(sign.RawGetString("encoding")),
+		prefix:          lua.LVAsString(sign.RawGetString("prefix")),
+		separator:       "\n",
+		timestampHeader: lua.LVAsString(sign.RawGetString("timestamp_header")),
+		timestampFormat: lua.LVAsString(sign.RawGetString("timestamp_format")),
+	}
+	if signer.secret == "" || signer.header == "" {
+		return nil, fmt.Errorf("sign requires a secret and a header")
+	}
+	if separator, ok := sign.RawGetString("separator").(lua.LString); ok {
+		signer.separator = string(separator)
+	}
+
+	switch algorithm := lua.LVAsString(sign.RawGetString("algorithm")); algorithm {
+	case "", "sha256":
+		signer.newHash = sha256.New
+	case "sha1":
+		signer.newHash = sha1.New
+	case "sha512":
+		signer.newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported sign algorithm %q", algorithm)
+	}
+
+	switch signer.encoding {
+	case "":
+		signer.encoding = "hex"
+	case "hex", "base64":
+	default:
+		return nil, fmt.Errorf("unsupported sign encoding %q", signer.encoding)
+	}
+
+	switch signer.timestampFormat {
+	case "":
+		signer.timestampFormat = "unix"
+	case "unix", "unix_ms", "rfc3339":
+	default:
+		return nil, fmt.Errorf("unsupported sign timestamp_format %q", signer.timestampFormat)
+	}
+
+	parts, ok := sign.RawGetString("parts").(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("sign requires a parts table")
+	}
+	var err error
+	parts.ForEach(func(_ lua.LValue, part lua.LValue) {
+		name := part.String()
+		switch {
+		case name == "method", name == "host", name == "path", name == "query", name == "uri",
+			name == "timestamp", name == "body", name == "body_sha256", strings.HasPrefix(name, "header:"):
+			signer.parts = append(signer.parts, name)
+		default:
+			err = fmt.Errorf("unsupported sign part %q", name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// sign computes the signature over req as it is about to be sent.
+func (s *hmacSigner) sign(req *http.Request) error {
+	// A timestamp header set by the script is kept, which makes signatures
+	// reproducible.
+	timestamp := ""
+	if s.timestampHeader != "" {
+		timestamp = req.Header.Get(s.timestampHeader)
+	}
+	if timestamp == "" {
+		timestamp = s.timestamp(time.Now())
+		if s.timestampHeader != "" {
+			req.Header.Set(s.timestampHeader, timestamp)
+		}
+	}
+
+	values := make([]string, len(s.parts))
+	for i, part := range s.parts {
+		switch part {
+		case "method":
+			values[i] = req.Method
+		case "host":
+			values[i] = req.Host
+			if values[i] == "" {
+				values[i] = req.URL.Host
+			}
+		case "path":
+			values[i] = req.URL.EscapedPath()
+		case "query":
+			values[i] = req.URL.RawQuery
+		case "uri":
+			values[i] = req.URL.RequestURI()
+		case "timestamp":
+			values[i] = timestamp
+		case "body", "body_sha256":
+			body, err := requestBody(req)
+			if err != nil {
+				return err
+			}
+			if part == "body" {
+				values[i] = string(body)
+			} else {
+				values[i] = sha256Hex(body)
+			}
+		default:
+			values[i] = req.Header.Get(strings.TrimPrefix(part, "header:"))
+		}
+	}
+
+	mac := hmac.New(s.newHash, []byte(s.secret))
+	mac.Write([]byte(strings.Join(values, s.separator)))
+	sum := mac.Sum(nil)
+
+	signature := hex.EncodeToString(sum)
+	if s.encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(sum)
+	}
+	req.Header.Set(s.header, s.prefix+signature)
+	return nil
+}
+
+func (s *hmacSigner) timestamp(t time.Time) string {
+	switch s.timestampFormat {
+	case "unix_ms":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case "rfc3339":
+		return t.UTC().Format(time.RFC3339)
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// requestBody returns the body of req without consuming it.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("request body can't be read twice")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
@@ -0,0 +1,83 @@
+package gluahttp
+
+import "github.com/yuin/gopher-lua"
+
+// luaHttpHooksKey is the registry field holding the hooks of a state, so
+// that scripts sharing a module don't see each other's hooks.
+const luaHttpHooksKey = "gluahttp.hooks"
+
+func httpHooks(L *lua.LState, name string) *lua.LTable {
+	hooks, ok := L.G.Registry.RawGetString(luaHttpHooksKey).(*lua.LTable)
+	if !ok {
+		hooks = L.NewTable()
+		hooks.RawSetString("request", L.NewTable())
+		hooks.RawSetString("response", L.NewTable())
+		L.G.Registry.RawSetString(luaHttpHooksKey, hooks)
+	}
+	return hooks.RawGetString(name).(*lua.LTable)
+}
+
+// httpOnRequest registers a function called with a table of the method,
+// url, headers and options of every request before it is sent. Changes made
+// to the table apply to the request.
+func httpOnRequest(L *lua.LState) int {
+	httpHooks(L, "request").Append(L.CheckFunction(1))
+	return 0
+}
+
+// httpOnResponse registers a function called with the http.response of
+// every request, or nil and the http.error when it failed.
+func httpOnResponse(L *lua.LState) int {
+	httpHooks(L, "response").Append(L.CheckFunction(1))
+	return 0
+}
+
+// runRequestHooks passes a copy of the request to the on_request hooks and
+// returns it as they left it.
+func runRequestHooks(L *lua.LState, method string, url string, options *lua.LTable) (string, string, *lua.LTable) {
+	hooks := httpHooks(L, "request")
+	if hooks.Len() == 0 {
+		return method, url, options
+	}
+
+	copied := L.NewTable()
+	headers := L.NewTable()
+	if options != nil {
+		options.ForEach(func(key lua.LValue, value lua.LValue) {
+			copied.RawSet(key, value)
+		})
+		if reqHeaders, ok := options.RawGetString("headers").(*lua.LTable); ok {
+			reqHeaders.ForEach(func(key lua.LValue, value lua.LValue) {
+				headers.RawSet(key, value)
+			})
+		}
+	}
+	copied.RawSetString("headers", headers)
+
+	request := L.NewTable()
+	request.RawSetString("method", lua.LString(method))
+	request.RawSetString("url", lua.LString(url))
+	request.RawSetString("headers", headers)
+	request.RawSetString("options", copied)
+
+	for i := 1; i <= hooks.Len(); i++ {
+		L.CallByParam(lua.P{Fn: hooks.RawGetInt(i), NRet: 0, Protect: false}, request)
+	}
+
+	options, ok := request.RawGetString("options").(*lua.LTable)
+	if !ok {
+		options = L.NewTable()
+	}
+	if headers, ok := request.RawGetString("headers").(*lua.LTable); ok {
+		options.RawSetString("headers", headers)
+	}
+	return lua.LVAsString(request.RawGetString("method")), lua.LVAsString(request.RawGetString("url")), options
+}
+
+// runResponseHooks passes the outcome of a request to the on_response hooks.
+func runResponseHooks(L *lua.LState, response lua.LValue, err lua.LValue) {
+	hooks := httpHooks(L, "response")
+	for i := 1; i <= hooks.Len(); i++ {
+		L.CallByParam(lua.P{Fn: hooks.RawGetInt(i), NRet: 0, Protect: false}, response, err)
+	}
+}
@@ -0,0 +1,285 @@
+package gluahttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const luaHttpErrorTypeName = "http.error"
+
+const (
+	errorKindTimeout        = "timeout"
+	errorKindDns            = "dns"
+	errorKindConnect        = "connect"
+	errorKindTls            = "tls"
+	errorKindCanceled       = "canceled"
+	errorKindInvalidUrl     = "invalid_url"
+	errorKindInvalidOption  = "invalid_option"
+	errorKindInvalidRequest = "invalid_request"
+	errorKindStatus         = "status"
+	errorKindUnknown        = "unknown"
+)
+
+// requestError annotates an error with the kind reported to Lua.
+type requestError struct {
+	kind string
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func errorWithKind(kind string, err error) error {
+	return &requestError{kind: kind, err: err}
+}
+
+// maxStatusErrorBody is how much of the response body a status error keeps.
+const maxStatusErrorBody = 512
+
+// statusError reports a response whose status code signals a failure.
+type statusError struct {
+	statusCode int
+	reason     string
+	url        string
+	body       string
+}
+
+func newStatusError(res *http.Response, body []byte) *statusError {
+	reason := strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode)+" ")
+	if reason == "" || reason == res.Status {
+		reason = http.StatusText(res.StatusCode)
+	}
+
+	excerpt := string(body)
+	if len(excerpt) > maxStatusErrorBody {
+		excerpt = excerpt[:maxStatusErrorBody] + "..."
+	}
+
+	return &statusError{
+		statusCode: res.StatusCode,
+		reason:     reason,
+		url:        res.Request.URL.String(),
+		body:       excerpt,
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s", e.statusCode, e.reason)
+}
+
+type luaHttpError struct {
+	kind       string
+	message    string
+	url        string
+	method     string
+	temporary  bool
+	statusCode int
+	reason     string
+	body       string
+}
+
+func registerHttpErrorType(module *lua.LTable, L *lua.LState) {
+	mt := L.NewTypeMetatable(luaHttpErrorTypeName)
+	L.SetField(mt, "__index", L.NewFunction(httpErrorIndex))
+	L.SetField(mt, "__tostring", L.NewFunction(httpErrorToString))
+	L.SetField(mt, "__concat", L.NewFunction(httpErrorConcat))
+
+	L.SetField(module, "error", mt)
+}
+
+func newHttpError(err error, method string, url string, L *lua.LState) *lua.LUserData {
+	kind := errorKind(err)
+	value := &luaHttpError{
+		kind:      kind,
+		message:   err.Error(),
+		url:       url,
+		method:    strings.ToUpper(method),
+		temporary: isTemporary(kind, err),
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		value.url = statusErr.url
+		value.statusCode = statusErr.statusCode
+		value.reason = statusErr.reason
+		value.body = statusErr.body
+	}
+
+	ud := L.NewUserData()
+	ud.Value = value
+	L.SetMetatable(ud, L.GetTypeMetatable(luaHttpErrorTypeName))
+	return ud
+}
+
+func checkHttpError(L *lua.LState, n int) *luaHttpError {
+	ud := L.CheckUserData(n)
+	if v, ok := ud.Value.(*luaHttpError); ok {
+		return v
+	}
+	L.ArgError(n, "http.error expected")
+	return nil
+}
+
+func httpErrorIndex(L *lua.LState) int {
+	err := checkHttpError(L, 1)
+
+	switch L.CheckString(2) {
+	case "kind":
+		L.Push(lua.LString(err.kind))
+		return 1
+	case "message":
+		L.Push(lua.LString(err.message))
+		return 1
+	case "url":
+		L.Push(lua.LString(err.url))
+		return 1
+	case "method":
+		L.Push(lua.LString(err.method))
+		return 1
+	case "temporary":
+		L.Push(lua.LBool(err.temporary))
+		return 1
+	case "status_code":
+		if err.statusCode == 0 {
+			return 0
+		}
+		L.Push(lua.LNumber(err.statusCode))
+		return 1
+	case "reason":
+		if err.statusCode == 0 {
+			return 0
+		}
+		L.Push(lua.LString(err.reason))
+		return 1
+	case "body":
+		if err.statusCode == 0 {
+			return 0
+		}
+		L.Push(lua.LString(err.body))
+		return 1
+	}
+
+	return 0
+}
+
+func httpErrorToString(L *lua.LState) int {
+	err := checkHttpError(L, 1)
+	L.Push(lua.LString(err.message))
+	return 1
+}
+
+// httpErrorConcat keeps `"failed: " .. err` working for scripts written
+// when errors were plain strings.
+func httpErrorConcat(L *lua.LState) int {
+	L.Push(lua.LString(L.ToStringMeta(L.Get(1)).String() + L.ToStringMeta(L.Get(2)).String()))
+	return 1
+}
+
+func errorKind(err error) string {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.kind
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return errorKindStatus
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return errorKindCanceled
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorKindTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorKindDns
+	}
+
+	if isTlsError(err) {
+		return errorKindTls
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorKindTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect") {
+		return errorKindConnect
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// net/http reports these as plain errors wrapped in a *url.Error.
+		message := urlErr.Err.Error()
+		if strings.Contains(message, "unsupported protocol scheme") || strings.Contains(message, "no Host in request URL") {
+			return errorKindInvalidUrl
+		}
+	}
+
+	return errorKindUnknown
+}
+
+func isTlsError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	// Alerts sent by the server, such as when it requires a client
+	// certificate, come as a *net.OpError wrapping an unexported type.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+func isTemporary(kind string, err error) bool {
+	switch kind {
+	case errorKindTimeout, errorKindConnect, errorKindConnectTimeout, errorKindResponseHeaderTimeout, errorKindReadIdleTimeout:
+		return true
+	case errorKindStatus:
+		var statusErr *statusError
+		if errors.As(err, &statusErr) {
+			switch statusErr.statusCode {
+			case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+				http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				return true
+			}
+		}
+	case errorKindDns:
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return dnsErr.IsTemporary || dnsErr.IsTimeout
+		}
+	}
+	return false
+}
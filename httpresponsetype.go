@@ -1,5 +1,6 @@
 package gluahttp
 
+import "fmt"
 import "github.com/yuin/gopher-lua"
 import "net/http"
 
@@ -9,22 +10,20 @@ type luaHttpResponse struct {
 	res      *http.Response
 	body     lua.LString
 	bodySize int
+	state    *requestState
 }
 
 func registerHttpResponseType(module *lua.LTable, L *lua.LState) {
 	mt := L.NewTypeMetatable(luaHttpResponseTypeName)
 	L.SetField(mt, "__index", L.NewFunction(httpResponseIndex))
+	L.SetField(mt, "__tostring", L.NewFunction(httpResponseToString))
 
 	L.SetField(module, "response", mt)
 }
 
-func newHttpResponse(res *http.Response, body *[]byte, bodySize int, L *lua.LState) *lua.LUserData {
+func newHttpResponse(res *luaHttpResponse, L *lua.LState) *lua.LUserData {
 	ud := L.NewUserData()
-	ud.Value = &luaHttpResponse{
-		res:      res,
-		body:     lua.LString(*body),
-		bodySize: bodySize,
-	}
+	ud.Value = res
 	L.SetMetatable(ud, L.GetTypeMetatable(luaHttpResponseTypeName))
 	return ud
 }
@@ -38,10 +37,50 @@ func checkHttpResponse(L *lua.LState) *luaHttpResponse {
 	return nil
 }
 
+// httpResponseFieldNames lists the attributes returned by response:fields().
+var httpResponseFieldNames = []string{
+	"status_code",
+	"status",
+	"proto",
+	"url",
+	"headers",
+	"cookies",
+	"trailers",
+	"content_length",
+	"transfer_encoding",
+	"uncompressed",
+	"content_encoding",
+	"body_size",
+	"body",
+	"redirect_history",
+	"timings",
+	"tls",
+	"from_cache",
+	"not_modified",
+	"etag",
+	"last_modified",
+}
+
 func httpResponseIndex(L *lua.LState) int {
 	res := checkHttpResponse(L)
 
-	switch L.CheckString(2) {
+	switch name := L.CheckString(2); name {
+	case "raise_for_status":
+		L.Push(L.NewFunction(httpResponseRaiseForStatus))
+		return 1
+	case "fields":
+		L.Push(L.NewFunction(httpResponseFields))
+		return 1
+	case "text":
+		L.Push(L.NewFunction(httpResponseText))
+		return 1
+	default:
+		return httpResponseField(res, L, name)
+	}
+}
+
+func httpResponseField(res *luaHttpResponse, L *lua.LState, name string) int {
+	switch name {
 	case "headers":
 		return httpResponseHeaders(res, L)
 	case "cookies":
@@ -54,6 +93,34 @@ func httpResponseIndex(L *lua.LState) int {
 		return httpResponseBody(res, L)
 	case "body_size":
 		return httpResponseBodySize(res, L)
+	case "status":
+		return httpResponseStatus(res, L)
+	case "proto":
+		return httpResponseProto(res, L)
+	case "content_length":
+		return httpResponseContentLength(res, L)
+	case "transfer_encoding":
+		return httpResponseTransferEncoding(res, L)
+	case "uncompressed":
+		return httpResponseUncompressed(res, L)
+	case "content_encoding":
+		return httpResponseContentEncoding(res, L)
+	case "trailers":
+		return httpResponseTrailers(res, L)
+	case "timings":
+		return httpResponseTimings(res, L)
+	case "redirect_history":
+		return httpResponseRedirectHistory(res, L)
+	case "tls":
+		return httpResponseTls(res, L)
+	case "from_cache":
+		return httpResponseFromCache(res, L)
+	case "not_modified":
+		return httpResponseNotModified(res, L)
+	case "etag":
+		return httpResponseEtag(res, L)
+	case "last_modified":
+		return httpResponseLastModified(res, L)
 	}
 
 	return 0
@@ -96,3 +163,161 @@ func httpResponseBodySize(res *luaHttpResponse, L *lua.LState) int {
 	L.Push(lua.LNumber(res.bodySize))
 	return 1
 }
+
+func httpResponseStatus(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(lua.LString(res.res.Status))
+	return 1
+}
+
+func httpResponseProto(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(lua.LString(res.res.Proto))
+	return 1
+}
+
+func httpResponseContentLength(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(lua.LNumber(res.res.ContentLength))
+	return 1
+}
+
+func httpResponseTransferEncoding(res *luaHttpResponse, L *lua.LState) int {
+	encodings := L.NewTable()
+	for _, encoding := range res.res.TransferEncoding {
+		encodings.Append(lua.LString(encoding))
+	}
+	L.Push(encodings)
+	return 1
+}
+
+func httpResponseUncompressed(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(lua.LBool(res.res.Uncompressed))
+	return 1
+}
+
+func httpResponseContentEncoding(res *luaHttpResponse, L *lua.LState) int {
+	if res.state.contentEncoding == "" {
+		return 0
+	}
+	L.Push(lua.LString(res.state.contentEncoding))
+	return 1
+}
+
+func httpResponseTrailers(res *luaHttpResponse, L *lua.LState) int {
+	trailers := L.NewTable()
+	for key, _ := range res.res.Trailer {
+		trailers.RawSetString(key, lua.LString(res.res.Trailer.Get(key)))
+	}
+	L.Push(trailers)
+	return 1
+}
+
+func httpResponseTimings(res *luaHttpResponse, L *lua.LState) int {
+	if res.state.timings == nil {
+		return 0
+	}
+	L.Push(res.state.timings.toTable(L))
+	return 1
+}
+
+func httpResponseRedirectHistory(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(redirectHistoryTable(res.state.history, L))
+	return 1
+}
+
+func httpResponseTls(res *luaHttpResponse, L *lua.LState) int {
+	if res.res.TLS == nil {
+		return 0
+	}
+	L.Push(tlsStateTable(res.res.TLS, L))
+	return 1
+}
+
+func httpResponseFromCache(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(lua.LBool(res.state.fromCache))
+	return 1
+}
+
+func httpResponseNotModified(res *luaHttpResponse, L *lua.LState) int {
+	L.Push(lua.LBool(res.res.StatusCode == http.StatusNotModified))
+	return 1
+}
+
+func httpResponseEtag(res *luaHttpResponse, L *lua.LState) int {
+	etag := res.res.Header.Get("ETag")
+	if etag == "" {
+		return 0
+	}
+	L.Push(lua.LString(etag))
+	return 1
+}
+
+// httpResponseLastModified returns the Last-Modified header in seconds since
+// the epoch, or nil when it is missing or invalid.
+func httpResponseLastModified(res *luaHttpResponse, L *lua.LState) int {
+	lastModified, err := http.ParseTime(res.res.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	L.Push(lua.LNumber(lastModified.Unix()))
+	return 1
+}
+
+func httpResponseToString(L *lua.LState) int {
+	res := checkHttpResponse(L)
+	L.Push(lua.LString(fmt.Sprintf("http.response: %s %s %s", res.res.Proto, res.res.Status, res.res.Request.URL)))
+	return 1
+}
+
+// httpResponseFields returns an iterator over the response attributes, for
+// use as `for name, value in response:fields() do ... end`.
+func httpResponseFields(L *lua.LState) int {
+	res := checkHttpResponse(L)
+	i := 0
+
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		for i < len(httpResponseFieldNames) {
+			name := httpResponseFieldNames[i]
+			i++
+
+			if httpResponseField(res, L, name) > 0 {
+				value := L.Get(-1)
+				L.Pop(1)
+				L.Push(lua.LString(name))
+				L.Push(value)
+				return 2
+			}
+		}
+		return 0
+	}))
+	return 1
+}
+
+// httpResponseRaiseForStatus raises an http.error when the response has a 4xx
+// or 5xx status code, otherwise it returns the response so calls can be chained.
+func httpResponseRaiseForStatus(L *lua.LState) int {
+	res := checkHttpResponse(L)
+
+	if res.res.StatusCode >= 400 {
+		err := newStatusError(res.res, []byte(res.body))
+		L.Error(newHttpError(err, res.res.Request.Method, err.url, L), 1)
+		return 0
+	}
+
+	L.Push(L.Get(1))
+	return 1
+}
+
+// httpResponseText returns the body transcoded to UTF-8, or nil and an
+// http.error when the charset is unknown.
+func httpResponseText(L *lua.LState) int {
+	res := checkHttpResponse(L)
+
+	text, err := decodeBody([]byte(res.body), res.res.Header.Get("Content-Type"), L.OptString(2, ""))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(newHttpError(err, res.res.Request.Method, res.res.Request.URL.String(), L))
+		return 2
+	}
+
+	L.Push(lua.LString(text))
+	return 1
+}
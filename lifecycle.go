@@ -0,0 +1,146 @@
+package gluahttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestLifecycle owns the context of a request from the moment it is sent
+// until its response body is closed. The deadline and the per-phase timeouts
+// therefore apply across redirects, authentication retries and reading the
+// body, whether the body is buffered or consumed later.
+type requestLifecycle struct {
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	timeouts requestTimeouts
+
+	mu          sync.Mutex
+	connectTmr  *time.Timer
+	headerTmr   *time.Timer
+	readIdleTmr *time.Timer
+	finished    bool
+}
+
+func newRequestLifecycle(parent context.Context, timeouts requestTimeouts) *requestLifecycle {
+	l := &requestLifecycle{timeouts: timeouts}
+
+	ctx := parent
+	var stopDeadline context.CancelFunc
+	if timeouts.total != 0 {
+		ctx, stopDeadline = context.WithTimeout(ctx, timeouts.total)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	l.cancel = func(cause error) {
+		cancel(cause)
+		if stopDeadline != nil {
+			stopDeadline()
+		}
+	}
+
+	if timeouts.connect != 0 || timeouts.responseHeader != 0 {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GetConn: func(hostPort string) {
+				l.arm(&l.connectTmr, timeouts.connect, errorKindConnectTimeout, "connect")
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				l.disarm(&l.connectTmr)
+			},
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				l.arm(&l.headerTmr, timeouts.responseHeader, errorKindResponseHeaderTimeout, "response header")
+			},
+			GotFirstResponseByte: func() {
+				l.disarm(&l.headerTmr)
+			},
+		})
+	}
+	l.ctx = ctx
+	return l
+}
+
+// arm cancels the request with an error of the given kind unless disarm is
+// called within timeout.
+func (l *requestLifecycle) arm(timer **time.Timer, timeout time.Duration, kind string, phase string) {
+	if timeout == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.finished {
+		return
+	}
+	if *timer != nil {
+		(*timer).Stop()
+	}
+	*timer = time.AfterFunc(timeout, func() {
+		l.cancel(errorWithKind(kind, fmt.Errorf("%s timeout of %s exceeded", phase, timeout)))
+	})
+}
+
+func (l *requestLifecycle) disarm(timer **time.Timer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
+
+// body ties the lifecycle to the response body: reads are subject to the
+// read idle timeout and closing the body ends the request.
+func (l *requestLifecycle) body(body io.ReadCloser) io.ReadCloser {
+	l.arm(&l.readIdleTmr, l.timeouts.readIdle, errorKindReadIdleTimeout, "read idle")
+	return &lifecycleBody{ReadCloser: body, lifecycle: l}
+}
+
+// finish releases the timers and the context. It is called when the body is
+// closed, or when the request failed before there was one.
+func (l *requestLifecycle) finish() {
+	l.mu.Lock()
+	l.finished = true
+	l.mu.Unlock()
+
+	l.disarm(&l.connectTmr)
+	l.disarm(&l.headerTmr)
+	l.disarm(&l.readIdleTmr)
+	l.cancel(nil)
+}
+
+// err returns the timeout that caused err, if any.
+func (l *requestLifecycle) err(err error) error {
+	var reqErr *requestError
+	if cause := context.Cause(l.ctx); errors.As(cause, &reqErr) {
+		return cause
+	}
+	return err
+}
+
+type lifecycleBody struct {
+	io.ReadCloser
+	lifecycle *requestLifecycle
+}
+
+func (b *lifecycleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	l := b.lifecycle
+	if err == nil {
+		l.arm(&l.readIdleTmr, l.timeouts.readIdle, errorKindReadIdleTimeout, "read idle")
+		return n, nil
+	}
+	l.disarm(&l.readIdleTmr)
+	if err == io.EOF {
+		return n, err
+	}
+	return n, l.err(err)
+}
+
+func (b *lifecycleBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.lifecycle.finish()
+	return err
+}
@@ -0,0 +1,130 @@
+package gluahttp
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	defaultRedactHeaders     = []string{"Authorization", "Cookie"}
+	defaultRedactQueryParams = []string{"token", "password"}
+)
+
+// requestLogger writes a record for every request made by scripts.
+type requestLogger struct {
+	logger      *slog.Logger
+	headers     map[string]bool
+	queryParams map[string]bool
+}
+
+func newRequestLogger(options Options) *requestLogger {
+	if options.Logger == nil {
+		return nil
+	}
+
+	headers := options.RedactHeaders
+	if headers == nil {
+		headers = defaultRedactHeaders
+	}
+	queryParams := options.RedactQueryParams
+	if queryParams == nil {
+		queryParams = defaultRedactQueryParams
+	}
+
+	l := &requestLogger{
+		logger:      options.Logger,
+		headers:     map[string]bool{},
+		queryParams: map[string]bool{},
+	}
+	for _, name := range headers {
+		l.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range queryParams {
+		l.queryParams[strings.ToLower(name)] = true
+	}
+	return l
+}
+
+// log records the outcome of a request. req and res are nil when the request
+// failed before being built or sent, err is already redacted.
+func (l *requestLogger) log(state *requestState, method string, rawUrl string, start time.Time, req *http.Request, res *http.Response, bytesIn int, err error) {
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+		rawUrl = req.URL.String()
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", strings.ToUpper(method)),
+		slog.String("url", l.redactUrl(rawUrl)),
+		slog.Duration("duration", time.Since(start)),
+		slog.Int("attempt", state.attempts),
+	}
+	if req != nil && req.ContentLength > 0 {
+		attrs = append(attrs, slog.Int64("bytes_out", req.ContentLength))
+	}
+	if res != nil {
+		attrs = append(attrs, slog.Int("status", res.StatusCode), slog.Int("bytes_in", bytesIn))
+	}
+	if state.fromCache {
+		attrs = append(attrs, slog.Bool("from_cache", true))
+	}
+
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error_kind", errorKind(err)), slog.String("error", l.redactError(err)))
+	}
+
+	if req != nil && l.logger.Enabled(ctx, slog.LevelDebug) {
+		headers := make([]any, 0, len(req.Header))
+		for name, values := range req.Header {
+			value := strings.Join(values, ", ")
+			if l.headers[name] {
+				value = redacted
+			}
+			headers = append(headers, slog.String(name, value))
+		}
+		attrs = append(attrs, slog.Group("headers", headers...))
+	}
+
+	l.logger.LogAttrs(ctx, level, "http request", attrs...)
+}
+
+// redactUrl hides the password of the URL and the values of sensitive query
+// parameters, keeping the order of the query.
+func (l *requestLogger) redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+
+	if u.RawQuery != "" {
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, pair := range pairs {
+			key, _, _ := strings.Cut(pair, "=")
+			if name, err := url.QueryUnescape(key); err == nil && l.queryParams[strings.ToLower(name)] {
+				pairs[i] = key + "=" + redacted
+			}
+		}
+		u.RawQuery = strings.Join(pairs, "&")
+	}
+	if _, ok := u.User.Password(); ok {
+		// url.Redacted writes the password as xxxxx.
+		return strings.Replace(u.Redacted(), ":xxxxx@", ":"+redacted+"@", 1)
+	}
+	return u.String()
+}
+
+// redactError hides the values of sensitive query parameters in the URLs
+// quoted by the message of err, and the passwords that net/http wrote as ***.
+func (l *requestLogger) redactError(err error) string {
+	message := strings.ReplaceAll(err.Error(), ":***@", ":"+redacted+"@")
+	return redactQueryParams(message, func(name string, value string) bool {
+		return l.queryParams[strings.ToLower(name)]
+	})
+}
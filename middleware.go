@@ -0,0 +1,37 @@
+package gluahttp
+
+import (
+	"github.com/yuin/gopher-lua"
+	"net/http"
+)
+
+// Middleware is called for every request sent by the module, including the
+// retries that answer authentication challenges and OAuth2 token requests,
+// and decides how to send it
+// by calling next, or answers it by itself. L is the state of the script that
+// made the request. In request_batch middlewares are called concurrently from
+// several goroutines, so they must not call Lua functions on L.
+type Middleware func(L *lua.LState, req *http.Request, next func(req *http.Request) (*http.Response, error)) (*http.Response, error)
+
+// Use adds middlewares to the module. The first middleware added is the
+// first to see each request.
+func (h *httpModule) Use(middlewares ...Middleware) *httpModule {
+	h.middlewares = append(h.middlewares, middlewares...)
+	return h
+}
+
+// exchange sends req through the middlewares, then the cache and the
+// transport.
+func (h *httpModule) exchange(req *http.Request, state *requestState) (*http.Response, error) {
+	state.attempts++
+	next := func(req *http.Request) (*http.Response, error) {
+		return h.cachedRoundTrip(req, state)
+	}
+	for i := len(h.middlewares) - 1; i >= 0; i-- {
+		middleware, inner := h.middlewares[i], next
+		next = func(req *http.Request) (*http.Response, error) {
+			return middleware(state.L, req, inner)
+		}
+	}
+	return next(req)
+}
@@ -0,0 +1,236 @@
+package gluahttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const luaOAuth2ProviderTypeName = "http.oauth2"
+
+// oauth2ExpiryDelta is how long before their expiry cached tokens are
+// considered stale, so that they don't expire while a request is in flight.
+const oauth2ExpiryDelta = 30 * time.Second
+
+// OAuth2Provider fetches OAuth2 access tokens with the client credentials
+// grant, or the refresh token grant when RefreshToken is set, and caches them
+// until shortly before they expire. It is safe for concurrent use.
+type OAuth2Provider struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// RefreshToken is replaced when the server issues a new one.
+	RefreshToken string
+	// EndpointParams are added to the token request body.
+	EndpointParams url.Values
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// accessToken returns the cached token, fetching a new one with do when
+// there is none or it is about to expire.
+func (p *OAuth2Provider) accessToken(ctx context.Context, do func(req *http.Request) (*http.Response, error)) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && (p.expiry.IsZero() || time.Now().Add(oauth2ExpiryDelta).Before(p.expiry)) {
+		return p.token, nil
+	}
+
+	form := url.Values{}
+	for key, values := range p.EndpointParams {
+		form[key] = values
+	}
+	if p.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", p.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(p.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.Scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errorWithKind(errorKindAuth, fmt.Errorf("oauth2 token request failed: %s", err))
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := do(req)
+	if err != nil {
+		return "", errorWithKind(errorKindAuth, fmt.Errorf("oauth2 token request failed: %s", err))
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", errorWithKind(errorKindAuth, fmt.Errorf("oauth2 token request failed: %s", err))
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", errorWithKind(errorKindAuth, fmt.Errorf("oauth2 token request failed: %s: %s", res.Status, body))
+	}
+
+	var token oauth2TokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", errorWithKind(errorKindAuth, fmt.Errorf("oauth2 token response is invalid: %s", err))
+	}
+	if token.AccessToken == "" {
+		return "", errorWithKind(errorKindAuth, fmt.Errorf("oauth2 token response has no access_token"))
+	}
+
+	p.token = token.AccessToken
+	p.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		p.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	if token.RefreshToken != "" {
+		p.RefreshToken = token.RefreshToken
+	}
+	return p.token, nil
+}
+
+// invalidate drops token from the cache unless another request already
+// replaced it.
+func (p *OAuth2Provider) invalidate(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token == token {
+		p.token = ""
+	}
+}
+
+func (p *OAuth2Provider) secrets() secrets {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := secrets{params: []string{p.ClientSecret, p.RefreshToken, p.token}}
+	if p.token != "" {
+		s.verbatim = []string{"Bearer " + p.token}
+	}
+	return s
+}
+
+// RegisterOAuth2 makes provider available to scripts as
+// auth={type="oauth2", provider=name}.
+func (h *httpModule) RegisterOAuth2(name string, provider *OAuth2Provider) *httpModule {
+	h.oauth2Providers[name] = provider
+	return h
+}
+
+type oauth2Auth struct {
+	provider *OAuth2Provider
+	module   *httpModule
+	// sentToken is the token used by the last authenticate call.
+	sentToken string
+}
+
+func (a *oauth2Auth) authenticate(req *http.Request) error {
+	// The token request goes through the middlewares and the transport of
+	// req, but must not pick up its redirect or auth options.
+	var state *requestState
+	if parent := requestStateFrom(req); parent != nil {
+		state = newRequestState(parent.L)
+		state.transport = parent.transport
+	} else {
+		state = newRequestState(nil)
+	}
+	ctx := context.WithValue(req.Context(), requestStateKey{}, state)
+	token, err := a.provider.accessToken(ctx, func(req *http.Request) (*http.Response, error) {
+		return a.module.exchange(req, state)
+	})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	a.sentToken = token
+	return nil
+}
+
+func (a *oauth2Auth) challenge(res *http.Response) (bool, error) {
+	a.provider.invalidate(a.sentToken)
+	return true, nil
+}
+
+func (a *oauth2Auth) secrets() secrets {
+	return a.provider.secrets()
+}
+
+func (h *httpModule) parseOAuth2Auth(reqAuth *lua.LTable) (authenticator, error) {
+	switch provider := reqAuth.RawGetString("provider").(type) {
+	case lua.LString:
+		if p, ok := h.oauth2Providers[string(provider)]; ok {
+			return &oauth2Auth{provider: p, module: h}, nil
+		}
+		return nil, fmt.Errorf("unknown oauth2 provider %q", string(provider))
+	case *lua.LUserData:
+		if p, ok := provider.Value.(*OAuth2Provider); ok {
+			return &oauth2Auth{provider: p, module: h}, nil
+		}
+	}
+	return nil, fmt.Errorf("oauth2 auth requires a provider")
+}
+
+func registerOAuth2ProviderType(module *lua.LTable, L *lua.LState) {
+	mt := L.NewTypeMetatable(luaOAuth2ProviderTypeName)
+	L.SetField(module, "oauth2_provider", mt)
+}
+
+// oauth2 creates a provider from Lua, for use as
+// auth={type="oauth2", provider=http.oauth2({...})}.
+func (h *httpModule) oauth2(L *lua.LState) int {
+	config := L.CheckTable(1)
+
+	provider := &OAuth2Provider{
+		TokenURL:     lua.LVAsString(config.RawGetString("token_url")),
+		ClientID:     lua.LVAsString(config.RawGetString("client_id")),
+		ClientSecret: lua.LVAsString(config.RawGetString("client_secret")),
+		RefreshToken: lua.LVAsString(config.RawGetString("refresh_token")),
+	}
+	if provider.TokenURL == "" {
+		L.ArgError(1, "token_url is required")
+	}
+
+	switch scopes := config.RawGetString("scopes").(type) {
+	case lua.LString:
+		provider.Scopes = strings.Fields(string(scopes))
+	case *lua.LTable:
+		scopes.ForEach(func(_ lua.LValue, scope lua.LValue) {
+			provider.Scopes = append(provider.Scopes, scope.String())
+		})
+	}
+
+	if params, ok := config.RawGetString("params").(*lua.LTable); ok {
+		provider.EndpointParams = url.Values{}
+		params.ForEach(func(key lua.LValue, value lua.LValue) {
+			provider.EndpointParams.Set(key.String(), value.String())
+		})
+	}
+
+	ud := L.NewUserData()
+	ud.Value = provider
+	L.SetMetatable(ud, L.GetTypeMetatable(luaOAuth2ProviderTypeName))
+	L.Push(ud)
+	return 1
+}
@@ -0,0 +1,209 @@
+package gluahttp
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/yuin/gopher-lua"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Options configure a module created with NewHttpModuleWithOptions. Zero
+// values keep the setting of the client's transport.
+type Options struct {
+	// MaxConnsPerHost limits the connections to each host, including the
+	// ones in use.
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is how many idle connections are kept for reuse
+	// for each host.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept.
+	IdleConnTimeout time.Duration
+	// DialTimeout limits how long connecting to a host may take.
+	DialTimeout time.Duration
+	// TlsHandshakeTimeout limits how long the TLS handshake may take.
+	TlsHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout limits how long to wait for the response
+	// headers once the request was written.
+	ResponseHeaderTimeout time.Duration
+
+	// Logger receives a record for every request made by scripts. Request
+	// headers are included at the debug level.
+	Logger *slog.Logger
+	// RedactHeaders are the request headers whose values are not logged,
+	// Authorization and Cookie when nil.
+	RedactHeaders []string
+	// RedactQueryParams are the query parameters whose values are not
+	// logged, token and password when nil. Names are case insensitive.
+	RedactQueryParams []string
+}
+
+// NewHttpModuleWithOptions is like NewHttpModule, with a copy of the
+// client's transport tuned by options. The client's Transport must be nil or
+// an *http.Transport, any other RoundTripper is replaced by a copy of
+// http.DefaultTransport.
+func NewHttpModuleWithOptions(client *http.Client, options Options) *httpModule {
+	transport := cloneTransport(client.Transport)
+	options.apply(transport)
+
+	h := NewHttpModule(client)
+	h.transport = transport
+	h.client.Transport = h.pool.track(transport.Clone())
+	h.logger = newRequestLogger(options)
+	return h
+}
+
+func (o Options) apply(transport *http.Transport) {
+	if o.MaxConnsPerHost != 0 {
+		transport.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.TlsHandshakeTimeout != 0 {
+		transport.TLSHandshakeTimeout = o.TlsHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	}
+	if o.DialTimeout != 0 {
+		dial := dialContext(transport)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, o.DialTimeout)
+			defer cancel()
+			return dial(ctx, network, addr)
+		}
+	}
+}
+
+// cloneTransport returns a copy of rt, or of http.DefaultTransport when rt
+// isn't an *http.Transport.
+func cloneTransport(rt http.RoundTripper) *http.Transport {
+	if transport, ok := rt.(*http.Transport); ok {
+		return transport.Clone()
+	}
+	return http.DefaultTransport.(*http.Transport).Clone()
+}
+
+func dialContext(transport *http.Transport) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if transport.DialContext != nil {
+		return transport.DialContext
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return dialer.DialContext
+}
+
+// poolStats counts the connections of the transports built by a module.
+type poolStats struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]int
+}
+
+func newPoolStats() *poolStats {
+	return &poolStats{conns: map[*trackedConn]int{}}
+}
+
+// trackedConn removes itself from the pool stats when it is closed.
+type trackedConn struct {
+	net.Conn
+	addr  string
+	stats *poolStats
+	once  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.stats.mu.Lock()
+		delete(c.stats.conns, c)
+		c.stats.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// track makes the connections dialed by transport show up in the stats.
+func (s *poolStats) track(transport *http.Transport) *http.Transport {
+	dial := dialContext(transport)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tracked := &trackedConn{Conn: conn, addr: addr, stats: s}
+		s.mu.Lock()
+		s.conns[tracked] = 0
+		s.mu.Unlock()
+		return tracked, nil
+	}
+	return transport
+}
+
+// clientTrace marks the connections used by a request as active until
+// release is called with state.
+func (s *poolStats) clientTrace(state *requestState) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+			tracked, ok := conn.(*trackedConn)
+			if !ok {
+				return
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if _, open := s.conns[tracked]; open {
+				s.conns[tracked]++
+				state.conns = append(state.conns, tracked)
+			}
+		},
+	}
+}
+
+func (s *poolStats) release(state *requestState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range state.conns {
+		if _, open := s.conns[conn]; open {
+			s.conns[conn]--
+		}
+	}
+	state.conns = nil
+}
+
+// poolStats returns the number of idle and active connections of each
+// host:port, for the connections made by the transports the module built.
+func (h *httpModule) poolStats(L *lua.LState) int {
+	h.pool.mu.Lock()
+	defer h.pool.mu.Unlock()
+
+	stats := L.NewTable()
+	for conn, requests := range h.pool.conns {
+		host, ok := stats.RawGetString(conn.addr).(*lua.LTable)
+		if !ok {
+			host = L.NewTable()
+			host.RawSetString("idle", lua.LNumber(0))
+			host.RawSetString("active", lua.LNumber(0))
+			stats.RawSetString(conn.addr, host)
+		}
+
+		field := "idle"
+		if requests > 0 {
+			field = "active"
+		}
+		host.RawSetString(field, host.RawGetString(field).(lua.LNumber)+1)
+	}
+
+	L.Push(stats)
+	return 1
+}
@@ -0,0 +1,143 @@
+package gluahttp
+
+import (
+	"context"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"golang.org/x/net/http/httpproxy"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const errorKindProxyAuth = "proxy_auth"
+
+// proxyOptions replaces the proxy settings of the host's transport.
+type proxyOptions struct {
+	// set distinguishes a direct connection, with an empty url, from the
+	// host's own proxy settings.
+	set     bool
+	url     string
+	noProxy string
+}
+
+// SetProxy sends every request through proxyUrl, unless its host matches
+// noProxy, a comma separated list in the format of the NO_PROXY environment
+// variable. An empty proxyUrl makes requests ignore the host's proxy
+// settings. Scripts can override both with the proxy and no_proxy options.
+func (h *httpModule) SetProxy(proxyUrl string, noProxy string) *httpModule {
+	h.proxy = proxyOptions{set: true, url: proxyUrl, noProxy: noProxy}
+	return h
+}
+
+func parseProxyOptions(options *lua.LTable, proxy *proxyOptions) error {
+	switch value := options.RawGetString("proxy").(type) {
+	case lua.LString:
+		proxy.set = true
+		proxy.url = string(value)
+	case lua.LBool:
+		if value {
+			return fmt.Errorf("proxy must be a URL or false")
+		}
+		proxy.set = true
+		proxy.url = ""
+	}
+
+	switch value := options.RawGetString("no_proxy").(type) {
+	case lua.LString:
+		proxy.noProxy = string(value)
+	case *lua.LTable:
+		var hosts []string
+		value.ForEach(func(_ lua.LValue, host lua.LValue) {
+			hosts = append(hosts, host.String())
+		})
+		proxy.noProxy = strings.Join(hosts, ",")
+	}
+
+	if proxy.url == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy.url)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("proxy must be a URL such as http://host:port")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+func (o proxyOptions) apply(transport *http.Transport) {
+	if !o.set {
+		if transport.Proxy != nil {
+			transport.Proxy = bypassProxy(transport.Proxy, o.noProxy)
+		}
+		return
+	}
+	if o.url == "" {
+		transport.Proxy = nil
+		return
+	}
+
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  o.url,
+		HTTPSProxy: o.url,
+		NoProxy:    o.noProxy,
+	}).ProxyFunc()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	transport.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, res *http.Response) error {
+		if res.StatusCode == http.StatusProxyAuthRequired {
+			return errorWithKind(errorKindProxyAuth, fmt.Errorf("proxy authentication failed: %s", res.Status))
+		}
+		return nil
+	}
+}
+
+// bypassProxy connects directly to the hosts matching noProxy, and uses
+// proxy, such as the host's environment settings, for the others.
+func bypassProxy(proxy func(*http.Request) (*url.URL, error), noProxy string) func(*http.Request) (*url.URL, error) {
+	match := (&httpproxy.Config{
+		HTTPProxy:  "http://proxy.invalid",
+		HTTPSProxy: "http://proxy.invalid",
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		if u, err := match(req.URL); err != nil || u == nil {
+			return nil, err
+		}
+		return proxy(req)
+	}
+}
+
+func (o proxyOptions) secrets() secrets {
+	u, err := url.Parse(o.url)
+	if err != nil || u.User == nil {
+		return secrets{}
+	}
+	password, _ := u.User.Password()
+	return secrets{verbatim: []string{u.User.String() + "@"}, params: []string{password}}
+}
+
+// checkProxyAuth turns the ways a proxy can reject credentials into errors
+// of kind proxy_auth: a 407 response to a plain HTTP request, or a failed
+// SOCKS5 handshake. Refused CONNECT requests are handled by apply.
+func checkProxyAuth(res *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		message := err.Error()
+		if strings.Contains(message, "username/password authentication failed") ||
+			strings.Contains(message, "no acceptable authentication methods") {
+			return nil, errorWithKind(errorKindProxyAuth, err)
+		}
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusProxyAuthRequired {
+		res.Body.Close()
+		return nil, errorWithKind(errorKindProxyAuth, fmt.Errorf("proxy authentication failed: %s", res.Status))
+	}
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package gluahttp
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"net/http"
+)
+
+const errorKindTooManyRedirects = "too_many_redirects"
+
+// defaultMaxRedirects matches what http.Client allows without a CheckRedirect.
+const defaultMaxRedirects = 10
+
+// defaultRedirectPolicy leaves redirects to the client's CheckRedirect.
+var defaultRedirectPolicy = redirectPolicy{follow: true, max: -1}
+
+type redirectPolicy struct {
+	follow   bool
+	max      int
+	keepAuth bool
+}
+
+type redirectHop struct {
+	url        string
+	statusCode int
+}
+
+func parseRedirectPolicy(options *lua.LTable, policy *redirectPolicy) error {
+	if follow := options.RawGetString("follow_redirects"); follow != lua.LNil {
+		policy.follow = lua.LVAsBool(follow)
+	}
+
+	switch max := options.RawGetString("max_redirects").(type) {
+	case lua.LNumber:
+		if max < 0 {
+			return fmt.Errorf("max_redirects must not be negative")
+		}
+		policy.max = int(max)
+	}
+
+	policy.keepAuth = lua.LVAsBool(options.RawGetString("keep_auth_on_redirect"))
+	return nil
+}
+
+// checkRedirect wraps the client's CheckRedirect so that every hop is
+// recorded and the per-request redirect options are honoured.
+func checkRedirect(next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		state := requestStateFrom(req)
+		if state == nil {
+			if next != nil {
+				return next(req, via)
+			}
+			return limitRedirects(via, defaultMaxRedirects)
+		}
+
+		policy := state.redirect
+		if !policy.follow {
+			return http.ErrUseLastResponse
+		}
+
+		var err error
+		switch {
+		case policy.max >= 0:
+			err = limitRedirects(via, policy.max)
+		case next != nil:
+			err = next(req, via)
+		default:
+			err = limitRedirects(via, defaultMaxRedirects)
+		}
+		if err != nil {
+			return err
+		}
+
+		state.history = append(state.history, redirectHop{
+			url:        via[len(via)-1].URL.String(),
+			statusCode: req.Response.StatusCode,
+		})
+
+		// http.Client drops Authorization when redirecting to another host.
+		if policy.keepAuth {
+			if auth := via[0].Header.Get("Authorization"); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+		}
+
+		return nil
+	}
+}
+
+func limitRedirects(via []*http.Request, max int) error {
+	if len(via) > max {
+		return errorWithKind(errorKindTooManyRedirects, fmt.Errorf("stopped after %d redirects", max))
+	}
+	return nil
+}
+
+func redirectHistoryTable(history []redirectHop, L *lua.LState) *lua.LTable {
+	hops := L.NewTable()
+	for _, hop := range history {
+		entry := L.NewTable()
+		entry.RawSetString("url", lua.LString(hop.url))
+		entry.RawSetString("status_code", lua.LNumber(hop.statusCode))
+		hops.Append(entry)
+	}
+	return hops
+}
@@ -0,0 +1,89 @@
+package gluahttp
+
+import (
+	"context"
+	"github.com/yuin/gopher-lua"
+	"net/http"
+)
+
+type requestStateKey struct{}
+
+// requestState travels with a request through the http.Client so that hooks
+// such as CheckRedirect can see the per-request options, and collects what
+// the Lua response exposes besides the *http.Response itself.
+type requestState struct {
+	// L is the state of the script that made the request.
+	L *lua.LState
+
+	auth   authenticator
+	signer *hmacSigner
+	// transport is nil when the module's client can send the request.
+	transport *transportConfig
+	timings   *requestTimings
+	timeouts  requestTimeouts
+	redirect  redirectPolicy
+	history   []redirectHop
+	// attempts counts the times the request was sent, including retries.
+	attempts int
+
+	// conns are the pooled connections the request is using.
+	conns []*trackedConn
+
+	// noCache bypasses the module's cache, fromCache is set when the
+	// response was served or revalidated from it.
+	noCache   bool
+	fromCache bool
+
+	// contentEncoding lists the codings undone on the response body.
+	contentEncoding string
+
+	// secrets are redacted from the error returned for the request.
+	secrets secrets
+}
+
+func newRequestState(L *lua.LState) *requestState {
+	return &requestState{
+		L:        L,
+		redirect: defaultRedirectPolicy,
+	}
+}
+
+// prepare adds credentials and signatures to req right before it is sent.
+func (s *requestState) prepare(req *http.Request) error {
+	if s.auth != nil {
+		if err := s.auth.authenticate(req); err != nil {
+			return err
+		}
+	}
+	if s.signer != nil {
+		if err := s.signer.sign(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redact hides the credentials used by the request from the message of err.
+func (s *requestState) redact(err error) error {
+	var hidden secrets
+	hidden.add(s.secrets)
+	if s.auth != nil {
+		hidden.add(s.auth.secrets())
+	}
+	if s.signer != nil {
+		hidden.add(secrets{params: []string{s.signer.secret}})
+	}
+	if s.transport != nil {
+		hidden.add(s.transport.proxy.secrets())
+	}
+	return redactSecrets(err, hidden)
+}
+
+func withRequestState(req *http.Request, state *requestState) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state))
+}
+
+func requestStateFrom(req *http.Request) *requestState {
+	state, _ := req.Context().Value(requestStateKey{}).(*requestState)
+	return state
+}
@@ -0,0 +1,103 @@
+package gluahttp
+
+import (
+	"crypto/tls"
+	"github.com/yuin/gopher-lua"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestTimings collects how long each phase of a request took. The
+// httptrace hooks may fire from the transport's dialing goroutines, so
+// every access goes through mu.
+type requestTimings struct {
+	mu sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	firstByte    time.Time
+	done         time.Time
+
+	dns          time.Duration
+	connect      time.Duration
+	tlsHandshake time.Duration
+	reused       bool
+}
+
+func newRequestTimings() *requestTimings {
+	return &requestTimings{start: time.Now()}
+}
+
+func (t *requestTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dns += time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connect += time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsHandshake += time.Since(t.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+// finish marks the end of the request, once the body has been read.
+func (t *requestTimings) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = time.Now()
+}
+
+// toTable returns the timings in seconds. When redirects are followed, dns,
+// connect and tls_handshake add up every hop while ttfb is measured to the
+// first byte of the final response.
+func (t *requestTimings) toTable(L *lua.LState) *lua.LTable {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timings := L.NewTable()
+	timings.RawSetString("dns", lua.LNumber(t.dns.Seconds()))
+	timings.RawSetString("connect", lua.LNumber(t.connect.Seconds()))
+	timings.RawSetString("tls_handshake", lua.LNumber(t.tlsHandshake.Seconds()))
+	if !t.firstByte.IsZero() {
+		timings.RawSetString("ttfb", lua.LNumber(t.firstByte.Sub(t.start).Seconds()))
+	}
+	timings.RawSetString("total", lua.LNumber(t.done.Sub(t.start).Seconds()))
+	timings.RawSetString("reused", lua.LBool(t.reused))
+	return timings
+}
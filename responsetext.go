@@ -0,0 +1,57 @@
+package gluahttp
+
+import (
+	"fmt"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"mime"
+)
+
+const errorKindCharset = "charset"
+
+// decodeBody transcodes a response body to UTF-8. The charset is taken from
+// label when given, then from the Content-Type header, and for HTML documents
+// from a byte order mark or <meta> tag. Anything else is assumed to already
+// be UTF-8 and is returned untouched.
+func decodeBody(body []byte, contentType string, label string) (string, error) {
+	e, err := bodyEncoding(body, contentType, label)
+	if err != nil {
+		return "", errorWithKind(errorKindCharset, err)
+	}
+	if e == nil {
+		return string(body), nil
+	}
+
+	text, err := e.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", errorWithKind(errorKindCharset, err)
+	}
+	return string(text), nil
+}
+
+func bodyEncoding(body []byte, contentType string, label string) (encoding.Encoding, error) {
+	if label != "" {
+		return lookupCharset(label)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if label := params["charset"]; label != "" {
+		return lookupCharset(label)
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		e, _, _ := charset.DetermineEncoding(body, contentType)
+		return e, nil
+	}
+
+	return nil, nil
+}
+
+func lookupCharset(label string) (encoding.Encoding, error) {
+	e, _ := charset.Lookup(label)
+	if e == nil {
+		return nil, fmt.Errorf("unsupported charset %q", label)
+	}
+	return e, nil
+}
@@ -0,0 +1,49 @@
+package gluahttp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"github.com/yuin/gopher-lua"
+)
+
+// tlsStateTable describes the TLS connection a response was received on.
+func tlsStateTable(state *tls.ConnectionState, L *lua.LState) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("version", lua.LString(tls.VersionName(state.Version)))
+	table.RawSetString("cipher_suite", lua.LString(tls.CipherSuiteName(state.CipherSuite)))
+	table.RawSetString("negotiated_protocol", lua.LString(state.NegotiatedProtocol))
+	table.RawSetString("server_name", lua.LString(state.ServerName))
+	table.RawSetString("resumed", lua.LBool(state.DidResume))
+
+	certificates := L.NewTable()
+	for _, cert := range state.PeerCertificates {
+		sans := L.NewTable()
+		for _, name := range cert.DNSNames {
+			sans.Append(lua.LString(name))
+		}
+		for _, ip := range cert.IPAddresses {
+			sans.Append(lua.LString(ip.String()))
+		}
+		for _, email := range cert.EmailAddresses {
+			sans.Append(lua.LString(email))
+		}
+		for _, uri := range cert.URIs {
+			sans.Append(lua.LString(uri.String()))
+		}
+
+		fingerprint := sha256.Sum256(cert.Raw)
+
+		certificate := L.NewTable()
+		certificate.RawSetString("subject", lua.LString(cert.Subject.String()))
+		certificate.RawSetString("issuer", lua.LString(cert.Issuer.String()))
+		certificate.RawSetString("sans", sans)
+		certificate.RawSetString("not_before", lua.LNumber(cert.NotBefore.Unix()))
+		certificate.RawSetString("not_after", lua.LNumber(cert.NotAfter.Unix()))
+		certificate.RawSetString("sha256_fingerprint", lua.LString(hex.EncodeToString(fingerprint[:])))
+		certificates.Append(certificate)
+	}
+	table.RawSetString("peer_certificates", certificates)
+
+	return table
+}
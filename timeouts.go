@@ -0,0 +1,72 @@
+package gluahttp
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"time"
+)
+
+const (
+	errorKindConnectTimeout        = "connect_timeout"
+	errorKindResponseHeaderTimeout = "response_header_timeout"
+	errorKindReadIdleTimeout       = "read_idle_timeout"
+)
+
+// requestTimeouts are the limits set by the timeout options. Zero means no
+// limit.
+type requestTimeouts struct {
+	// total covers the whole request, from connecting to reading the last
+	// byte of the response body, across redirects and retries.
+	total          time.Duration
+	connect        time.Duration
+	responseHeader time.Duration
+	readIdle       time.Duration
+}
+
+// parseTimeout reads a timeout option given in seconds or as a duration
+// string such as "1m30s". Zero means no limit.
+func parseTimeout(value lua.LValue) (time.Duration, error) {
+	var duration time.Duration
+	switch value := value.(type) {
+	case lua.LNumber:
+		duration = time.Duration(float64(value) * float64(time.Second))
+	case lua.LString:
+		var err error
+		if duration, err = time.ParseDuration(string(value)); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("timeout must be a number of seconds or a duration")
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("timeout must not be negative")
+	}
+	return duration, nil
+}
+
+func parseRequestTimeouts(options *lua.LTable) (requestTimeouts, error) {
+	timeouts := requestTimeouts{}
+	for _, option := range []struct {
+		name    string
+		timeout *time.Duration
+	}{
+		{"timeout", &timeouts.total},
+		{"connect_timeout", &timeouts.connect},
+		{"response_header_timeout", &timeouts.responseHeader},
+		{"read_idle_timeout", &timeouts.readIdle},
+	} {
+		value := options.RawGetString(option.name)
+		if value == lua.LNil {
+			continue
+		}
+		duration, err := parseTimeout(value)
+		if err != nil {
+			if option.name == "timeout" {
+				return requestTimeouts{}, err
+			}
+			return requestTimeouts{}, fmt.Errorf("%s: %s", option.name, err)
+		}
+		*option.timeout = duration
+	}
+	return timeouts, nil
+}
@@ -0,0 +1,263 @@
+package gluahttp
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transportConfig describes a transport built for per-request options that
+// the host's transport can't honour. It is comparable so that requests with
+// the same options share a transport and its connection pool.
+type transportConfig struct {
+	tls         tlsOptions
+	proxy       proxyOptions
+	unixSocket  string
+	httpVersion string
+}
+
+type tlsOptions struct {
+	caPem              string
+	certPem            string
+	keyPem             string
+	serverName         string
+	minVersion         uint16
+	insecureSkipVerify bool
+}
+
+// maxTransports bounds the transports kept for per-request options, since
+// scripts may vary them, such as server_name, on every request.
+const maxTransports = 32
+
+// defaultIdleConnTimeout is used by the transports built for per-request
+// options when the host's has no limit, the same as http.DefaultTransport.
+// Connections that requests return to an evicted transport are closed after
+// it.
+const defaultIdleConnTimeout = 90 * time.Second
+
+// transports caches the clients built for each transportConfig, evicting
+// the least recently used ones.
+type transports struct {
+	mu      sync.Mutex
+	clients map[transportConfig]*list.Element
+	order   *list.List
+}
+
+type transportsEntry struct {
+	config    transportConfig
+	client    *http.Client
+	transport *http.Transport
+}
+
+func newTransports() *transports {
+	return &transports{clients: map[transportConfig]*list.Element{}, order: list.New()}
+}
+
+// httpVersions maps the http_version option to the protocols the transport
+// may use.
+var httpVersions = map[string]func(p *http.Protocols){
+	"1.1": func(p *http.Protocols) { p.SetHTTP1(true) },
+	"2":   func(p *http.Protocols) { p.SetHTTP2(true) },
+	"h2c": func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) },
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTransportConfig returns nil when the module's client can send the
+// request. options may be nil, unixSocket is the socket given in the URL.
+func (h *httpModule) parseTransportConfig(options *lua.LTable, unixSocket string) (*transportConfig, error) {
+	config := transportConfig{proxy: h.proxy, unixSocket: unixSocket}
+
+	if options != nil {
+		if err := parseProxyOptions(options, &config.proxy); err != nil {
+			return nil, err
+		}
+
+		if socket, ok := options.RawGetString("unix_socket").(lua.LString); ok {
+			config.unixSocket = string(socket)
+		}
+
+		if version := lua.LVAsString(options.RawGetString("http_version")); version != "" {
+			if _, ok := httpVersions[version]; !ok {
+				return nil, fmt.Errorf("unsupported http_version %q", version)
+			}
+			config.httpVersion = version
+		}
+
+		var err error
+		if config.tls, err = h.parseTlsOptions(options); err != nil {
+			return nil, err
+		}
+	}
+
+	if config == (transportConfig{}) {
+		return nil, nil
+	}
+	if h.client == nil {
+		return nil, fmt.Errorf("tls, proxy, unix_socket and http_version options require a module created with NewHttpModule")
+	}
+	return &config, nil
+}
+
+func (h *httpModule) parseTlsOptions(options *lua.LTable) (tlsOptions, error) {
+	reqTls, ok := options.RawGetString("tls").(*lua.LTable)
+	if !ok {
+		return tlsOptions{}, nil
+	}
+
+	config := tlsOptions{
+		caPem:              lua.LVAsString(reqTls.RawGetString("ca_pem")),
+		certPem:            lua.LVAsString(reqTls.RawGetString("cert_pem")),
+		keyPem:             lua.LVAsString(reqTls.RawGetString("key_pem")),
+		serverName:         lua.LVAsString(reqTls.RawGetString("server_name")),
+		insecureSkipVerify: lua.LVAsBool(reqTls.RawGetString("insecure_skip_verify")),
+	}
+
+	if version := lua.LVAsString(reqTls.RawGetString("min_version")); version != "" {
+		minVersion, ok := tlsVersions[version]
+		if !ok {
+			return tlsOptions{}, fmt.Errorf("unsupported tls min_version %q", version)
+		}
+		config.minVersion = minVersion
+	}
+
+	if config.insecureSkipVerify && !h.allowInsecureTls {
+		return tlsOptions{}, fmt.Errorf("tls insecure_skip_verify is not allowed by the host")
+	}
+	return config, nil
+}
+
+// clientFor returns a copy of the module's client using a transport built
+// for config.
+func (h *httpModule) clientFor(config transportConfig) (*http.Client, error) {
+	h.transports.mu.Lock()
+	defer h.transports.mu.Unlock()
+
+	if element, ok := h.transports.clients[config]; ok {
+		h.transports.order.MoveToFront(element)
+		return element.Value.(*transportsEntry).client, nil
+	}
+
+	transport, err := h.newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *h.client
+	client.Transport = transport
+	h.transports.clients[config] = h.transports.order.PushFront(&transportsEntry{config: config, client: &client, transport: transport})
+
+	for h.transports.order.Len() > maxTransports {
+		// Requests still using the evicted transport complete, its idle
+		// connections are closed.
+		oldest := h.transports.order.Back()
+		h.transports.order.Remove(oldest)
+		entry := oldest.Value.(*transportsEntry)
+		delete(h.transports.clients, entry.config)
+		entry.transport.CloseIdleConnections()
+	}
+	return &client, nil
+}
+
+// newTransport clones the module's transport, or the default one when the
+// host uses something other than an *http.Transport, and applies config.
+// Its connections show up in http.pool_stats().
+func (h *httpModule) newTransport(config transportConfig) (*http.Transport, error) {
+	var transport *http.Transport
+	if h.transport != nil {
+		transport = h.transport.Clone()
+	} else {
+		transport = cloneTransport(h.client.Transport)
+	}
+	if transport.IdleConnTimeout == 0 {
+		transport.IdleConnTimeout = defaultIdleConnTimeout
+	}
+
+	if config.tls != (tlsOptions{}) {
+		tlsConfig, err := config.tls.apply(transport.TLSClientConfig)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.proxy.set || config.proxy.noProxy != "" {
+		config.proxy.apply(transport)
+	}
+	if config.unixSocket != "" {
+		dialUnixSocket(transport, config.unixSocket)
+	}
+	if config.httpVersion != "" {
+		protocols := &http.Protocols{}
+		httpVersions[config.httpVersion](protocols)
+		transport.Protocols = protocols
+		if config.httpVersion == "1.1" && transport.TLSClientConfig != nil {
+			// The host's config may offer h2 during the handshake.
+			transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+			transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+	}
+
+	return h.pool.track(transport), nil
+}
+
+func (o tlsOptions) apply(base *tls.Config) (*tls.Config, error) {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+
+	if o.caPem != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(o.caPem)) {
+			return nil, errorWithKind(errorKindInvalidOption, fmt.Errorf("tls ca_pem contains no certificate"))
+		}
+		config.RootCAs = pool
+	}
+
+	if o.certPem != "" || o.keyPem != "" {
+		cert, err := tls.X509KeyPair([]byte(o.certPem), []byte(o.keyPem))
+		if err != nil {
+			return nil, errorWithKind(errorKindInvalidOption, fmt.Errorf("tls cert_pem and key_pem are invalid: %s", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.serverName != "" {
+		config.ServerName = o.serverName
+	}
+	if o.minVersion != 0 {
+		config.MinVersion = o.minVersion
+	}
+	if o.insecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// roundTrip sends req with the module's client, or with one using a
+// dedicated transport when the request needs it.
+func (h *httpModule) roundTrip(req *http.Request, state *requestState) (*http.Response, error) {
+	if state.transport == nil {
+		return h.do(req)
+	}
+
+	client, err := h.clientFor(*state.transport)
+	if err != nil {
+		return nil, err
+	}
+	if state.transport.proxy.url != "" && state.transport.unixSocket == "" {
+		return checkProxyAuth(client.Do(req))
+	}
+	return client.Do(req)
+}
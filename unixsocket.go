@@ -0,0 +1,43 @@
+package gluahttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const unixSocketScheme = "http+unix://"
+
+// splitUnixSocketUrl turns a http+unix://<socket>/path URL, where socket is
+// the percent-encoded path of the socket, into a regular http://localhost
+// URL and the socket path. Other URLs are returned as they are.
+func splitUnixSocketUrl(rawUrl string) (string, string, error) {
+	if !strings.HasPrefix(strings.ToLower(rawUrl), unixSocketScheme) {
+		return rawUrl, "", nil
+	}
+
+	rest := rawUrl[len(unixSocketScheme):]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	socket, err := url.PathUnescape(rest[:end])
+	if err != nil || socket == "" {
+		return "", "", fmt.Errorf("%s URL must start with the percent-encoded path of a socket", unixSocketScheme)
+	}
+	return "http://localhost" + rest[end:], socket, nil
+}
+
+// dialUnixSocket makes transport connect to socket whatever the address of
+// the request.
+func dialUnixSocket(transport *http.Transport, socket string) {
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+}